@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const apiPrefix = "/api/v1/"
+
+type ApiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeApiJson(w http.ResponseWriter, status int, obj interface{}) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, fmt.Sprintf("Error encoding the response: %s", err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	data, _ := json.Marshal(ApiError{Code: status, Message: message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Maps the kubernetes API errors to HTTP status codes
+func writeApiK8sError(w http.ResponseWriter, err error) {
+	switch {
+	case apierrors.IsNotFound(err):
+		writeApiError(w, http.StatusNotFound, err.Error())
+	case apierrors.IsForbidden(err):
+		writeApiError(w, http.StatusForbidden, err.Error())
+	case apierrors.IsUnauthorized(err):
+		writeApiError(w, http.StatusUnauthorized, err.Error())
+	case apierrors.IsAlreadyExists(err), apierrors.IsConflict(err):
+		writeApiError(w, http.StatusConflict, err.Error())
+	case apierrors.IsBadRequest(err), apierrors.IsInvalid(err):
+		writeApiError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Returns the logged in user of the API request
+func (s *Server) getApiUser(w http.ResponseWriter, r *http.Request) *nautilusapi.PRPUser {
+	session, err := s.getSession(r)
+	if err != nil {
+		log.Printf("Error getting the session: %s", err.Error())
+	}
+
+	if session.IsNew || session.Values["userid"] == nil {
+		if err != nil && r.Header.Get("Authorization") != "" {
+			writeApiError(w, http.StatusUnauthorized, err.Error())
+		} else {
+			writeApiError(w, http.StatusUnauthorized, "Not logged in")
+		}
+		return nil
+	}
+
+	user, err := s.GetUser(session.Values["userid"].(string))
+	if err != nil {
+		writeApiK8sError(w, err)
+		return nil
+	}
+	return user
+}
+
+// Process the /api/v1/ path
+func (s *Server) ApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeApiError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s is not allowed", r.Method))
+		return
+	}
+
+	user := s.getApiUser(w, r)
+	if user == nil {
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+
+	cluster := s.getCluster(r.URL.Query().Get("cluster"))
+	if cluster == nil {
+		writeApiError(w, http.StatusNotFound, fmt.Sprintf("Unknown cluster %s", r.URL.Query().Get("cluster")))
+		return
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "clusters":
+		clusterNames := []string{}
+		for _, curCluster := range s.clusters {
+			clusterNames = append(clusterNames, curCluster.Name)
+		}
+		writeApiJson(w, http.StatusOK, clusterNames)
+	case len(path) == 1 && path[0] == "user":
+		writeApiJson(w, http.StatusOK, user)
+	case len(path) == 1 && path[0] == "users":
+		if user.Spec.Role != nautilusapi.RoleAdmin {
+			writeApiError(w, http.StatusForbidden, "Only admins can list users")
+			return
+		}
+		usersList, err := s.users.List(metav1.ListOptions{})
+		if err != nil {
+			writeApiK8sError(w, err)
+			return
+		}
+		writeApiJson(w, http.StatusOK, usersList.Items)
+	case len(path) == 2 && path[0] == "users":
+		if user.Spec.Role != nautilusapi.RoleAdmin && path[1] != user.GetName() {
+			writeApiError(w, http.StatusForbidden, "Only admins can view other users")
+			return
+		}
+		reqUser, err := s.users.Get(path[1], metav1.GetOptions{})
+		if err != nil {
+			writeApiK8sError(w, err)
+			return
+		}
+		writeApiJson(w, http.StatusOK, reqUser)
+	case len(path) == 1 && path[0] == "namespaces":
+		nsList, err := cluster.clientset.Core().Namespaces().List(metav1.ListOptions{})
+		if err != nil {
+			writeApiK8sError(w, err)
+			return
+		}
+		writeApiJson(w, http.StatusOK, nsList.Items)
+	case len(path) == 3 && path[0] == "namespaces" && path[2] == "members":
+		// Namespace members are only managed in the primary cluster
+		if cluster != s.clusters[0] {
+			writeApiError(w, http.StatusNotFound, fmt.Sprintf("Namespace members are managed in cluster %s", s.clusters[0].Name))
+			return
+		}
+		if _, err := cluster.clientset.Core().Namespaces().Get(path[1], metav1.GetOptions{}); err != nil {
+			writeApiK8sError(w, err)
+			return
+		}
+		if user.Spec.Role != nautilusapi.RoleAdmin && !cluster.IsNamespaceAdmin(user, path[1]) {
+			writeApiError(w, http.StatusForbidden, "Only namespace admins can view the members")
+			return
+		}
+		nsUsers, err := s.getNamespaceUsers(path[1])
+		if err != nil {
+			writeApiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeApiJson(w, http.StatusOK, nsUsers)
+	case len(path) == 3 && path[0] == "namespaces" && path[2] == "pods":
+		userclientset, err := cluster.GetUserClientset(user)
+		if err != nil {
+			writeApiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		podsList, err := userclientset.Core().Pods(path[1]).List(metav1.ListOptions{})
+		if err != nil {
+			writeApiK8sError(w, err)
+			return
+		}
+		writeApiJson(w, http.StatusOK, podsList.Items)
+	case len(path) == 1 && path[0] == "nodes":
+		nodesList, err := cluster.clientset.Core().Nodes().List(metav1.ListOptions{})
+		if err != nil {
+			writeApiK8sError(w, err)
+			return
+		}
+		writeApiJson(w, http.StatusOK, nodesList.Items)
+	case len(path) == 1 && path[0] == "tests":
+		src := r.URL.Query().Get("src")
+		dst := r.URL.Query().Get("dst")
+		test := r.URL.Query().Get("test")
+		if src == "" || dst == "" || test == "" {
+			writeApiError(w, http.StatusBadRequest, "The src, dst and test params are required")
+			return
+		}
+		res, err := RunTest(src, dst, test)
+		if err != nil {
+			writeApiError(w, http.StatusBadGateway, "Failed to retrieve results: "+err.Error())
+			return
+		}
+		writeApiJson(w, http.StatusOK, res)
+	default:
+		writeApiError(w, http.StatusNotFound, fmt.Sprintf("Unknown API path %s", r.URL.Path))
+	}
+}
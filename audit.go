@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The audited actions
+const (
+	auditNamespaceCreate     = "namespace.create"
+	auditNamespaceDelete     = "namespace.delete"
+	auditNamespaceSoftDelete = "namespace.soft-delete"
+	auditNamespaceRestore    = "namespace.restore"
+	auditNamespaceRenew      = "namespace.renew"
+	auditNamespaceArchive    = "namespace.archive"
+	auditNamespaceExpires    = "namespace.expires"
+	auditNamespaceMetadata   = "namespace.metadata"
+	auditNamespaceQuota      = "namespace.quota"
+	auditMemberAdd           = "member.add"
+	auditMemberRemove        = "member.remove"
+	auditMembershipRequest   = "membership.request"
+	auditMembershipReview    = "membership.review"
+	auditUserRole            = "user.role"
+	auditUserDelete          = "user.delete"
+	auditRBACRepair          = "rbac.repair"
+	auditRBACAdopt           = "rbac.adopt"
+)
+
+// The actor of the actions made by the portal itself
+const auditSystemActor = "system"
+
+// The events shown on the audit page at most
+const auditPageLimit = 500
+
+// AuditEvent is a change made from the portal
+type AuditEvent struct {
+	Time       time.Time   `json:"time"`
+	Actor      string      `json:"actor"` // PRPUser user ID, or "system"
+	ActorEmail string      `json:"actorEmail,omitempty"`
+	Action     string      `json:"action"`
+	Target     string      `json:"target"` // the changed object, f.e. the user ID for the member changes
+	Namespace  string      `json:"namespace,omitempty"`
+	Before     interface{} `json:"before,omitempty"`
+	After      interface{} `json:"after,omitempty"`
+	IP         string      `json:"ip,omitempty"`
+}
+
+// AuditFilter selects the audit events. Empty fields match all events.
+type AuditFilter struct {
+	Actor     string // user ID or email substring
+	Action    string
+	Namespace string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (filter AuditFilter) matches(event *AuditEvent) bool {
+	if filter.Actor != "" && !strings.Contains(event.Actor, filter.Actor) && !strings.Contains(event.ActorEmail, filter.Actor) {
+		return false
+	}
+	if filter.Action != "" && event.Action != filter.Action {
+		return false
+	}
+	if filter.Namespace != "" && event.Namespace != filter.Namespace {
+		return false
+	}
+	if !filter.Since.IsZero() && event.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !event.Time.Before(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog keeps the audit events in the append-only JSON lines file
+type AuditLog struct {
+	path string
+	lock sync.Mutex
+}
+
+// Creates the audit log in the file. The empty path disables the audit log.
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// Appends the event to the file
+func (auditLog *AuditLog) Append(event *AuditEvent) error {
+	if auditLog.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	auditLog.lock.Lock()
+	defer auditLog.lock.Unlock()
+
+	file, err := os.OpenFile(auditLog.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Calls the function for the events matching the filter, oldest first.
+// The log is locked meanwhile, so the function shouldn't block.
+func (auditLog *AuditLog) Scan(filter AuditFilter, fn func(event *AuditEvent, line []byte)) error {
+	if auditLog.path == "" {
+		return nil
+	}
+
+	auditLog.lock.Lock()
+	defer auditLog.lock.Unlock()
+
+	file, err := os.Open(auditLog.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			log.Printf("Error parsing the audit event %q: %s", scanner.Text(), err.Error())
+			continue
+		}
+		if filter.matches(event) {
+			fn(event, scanner.Bytes())
+		}
+	}
+	return scanner.Err()
+}
+
+// Returns the last events matching the filter, newest first
+func (auditLog *AuditLog) Query(filter AuditFilter, limit int) ([]*AuditEvent, error) {
+	events := []*AuditEvent{}
+	err := auditLog.Scan(filter, func(event *AuditEvent, line []byte) {
+		events = append(events, event)
+		if limit > 0 && len(events) > limit {
+			events = events[1:]
+		}
+	})
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, err
+}
+
+// Returns the client address of the request. The portal runs behind the ingress, which appends
+// the address it got the request from to X-Forwarded-For, so only the last one is trusted.
+func requestIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Records the change made by the user with the request. The nil user and request mean the portal made the change.
+func (s *Server) audit(r *http.Request, user *nautilusapi.PRPUser, action string, target string, nsName string, before interface{}, after interface{}) {
+	event := &AuditEvent{
+		Time:      time.Now().UTC(),
+		Actor:     auditSystemActor,
+		Action:    action,
+		Target:    target,
+		Namespace: nsName,
+		Before:    before,
+		After:     after,
+	}
+	if user != nil {
+		event.Actor = user.Spec.UserID
+		event.ActorEmail = user.Spec.Email
+	}
+	if r != nil {
+		event.IP = requestIP(r)
+	}
+	if err := s.auditLog.Append(event); err != nil {
+		log.Printf("Error writing the audit event %s of %s: %s", action, target, err.Error())
+	}
+}
+
+// Returns the lifecycle state of the namespace to record in the audit events, nil if the namespace can't be read
+func (s *Server) nsAuditState(nsName string) map[string]string {
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	state := map[string]string{}
+	for key, annotation := range map[string]string{"expires": nsExpiresAnnotation, "archived": nsArchivedAnnotation, "deleteAfter": nsDeleteAfterAnnotation} {
+		if value, ok := ns.Annotations[annotation]; ok {
+			state[key] = value
+		}
+	}
+	return state
+}
+
+type AuditTemplateVars struct {
+	IndexTemplateVars
+	Events  []*AuditEvent
+	Filter  AuditFilter
+	Since   string
+	Until   string
+	Actions []string
+	Limit   int
+}
+
+// The actions to filter by on the audit page
+var auditActions = []string{
+	auditNamespaceCreate, auditNamespaceDelete, auditNamespaceSoftDelete, auditNamespaceRestore, auditNamespaceRenew,
+	auditNamespaceArchive, auditNamespaceExpires, auditNamespaceMetadata, auditNamespaceQuota, auditMemberAdd,
+	auditMemberRemove, auditMembershipRequest, auditMembershipReview, auditUserRole, auditUserDelete, auditRBACRepair,
+	auditRBACAdopt,
+}
+
+// Reads the audit filter from the request. The dates are in nsExpiresFormat, and the until date is included.
+func auditFilterFromRequest(r *http.Request) (AuditFilter, error) {
+	filter := AuditFilter{
+		Actor:     r.URL.Query().Get("actor"),
+		Action:    r.URL.Query().Get("action"),
+		Namespace: r.URL.Query().Get("namespace"),
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		sinceTime, err := time.Parse(nsExpiresFormat, since)
+		if err != nil {
+			return filter, fmt.Errorf("The since date should be in YYYY-MM-DD format")
+		}
+		filter.Since = sinceTime
+	}
+	if until := r.URL.Query().Get("until"); until != "" {
+		untilTime, err := time.Parse(nsExpiresFormat, until)
+		if err != nil {
+			return filter, fmt.Errorf("The until date should be in YYYY-MM-DD format")
+		}
+		filter.Until = untilTime.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+// Process the /audit path - shows the audit events, or exports them as JSON lines with format=jsonl
+func (s *Server) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
+	if err != nil {
+		log.Printf("Error getting the session: %s", err.Error())
+	}
+
+	if session.IsNew || session.Values["userid"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := s.GetUser(session.Values["userid"].(string))
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if user.Spec.Role != nautilusapi.RoleAdmin {
+		session.AddFlash("Unauthorized")
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		session.AddFlash(err.Error())
+		session.Save(r, w)
+	}
+
+	if r.URL.Query().Get("format") == "jsonl" {
+		// Buffered, so that a slow download doesn't keep the log locked
+		var buf bytes.Buffer
+		if err := s.auditLog.Scan(filter, func(event *AuditEvent, line []byte) {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}); err != nil {
+			log.Printf("Error reading the audit log: %s", err.Error())
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"audit.jsonl\"")
+		buf.WriteTo(w)
+		return
+	}
+
+	events, err := s.auditLog.Query(filter, auditPageLimit)
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Error reading the audit log: %s", err.Error()))
+		session.Save(r, w)
+	}
+
+	t, err := template.New("layout.tmpl").ParseFiles("templates/layout.tmpl", "templates/audit.tmpl")
+	if err != nil {
+		w.Write([]byte(err.Error()))
+	} else {
+		err = t.ExecuteTemplate(w, "layout.tmpl", AuditTemplateVars{
+			IndexTemplateVars: s.buildIndexTemplateVars(session, w, r),
+			Events:            events,
+			Filter:            filter,
+			Since:             r.URL.Query().Get("since"),
+			Until:             r.URL.Query().Get("until"),
+			Actions:           auditActions,
+			Limit:             auditPageLimit,
+		})
+		if err != nil {
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
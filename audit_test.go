@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	env.addUser(testGuest, "guest")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"viewer"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+	env.post(client, "/nsMeta", url.Values{"pk": {"test-ns"}, "name": {"institution"}, "value": {"UCSD"}})
+	env.post(client, "/users", url.Values{"user": {testGuest.Subject}, "action": {"validate"}})
+
+	events, err := env.server.auditLog.Query(AuditFilter{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []string{}
+	for _, event := range events {
+		actions = append(actions, event.Action)
+		if event.Actor != testAdmin.Subject || event.ActorEmail != testAdmin.Email || event.IP == "" {
+			t.Errorf("Expected the actor and the address in %+v", event)
+		}
+	}
+	for _, action := range []string{auditNamespaceCreate, auditMemberAdd, auditNamespaceMetadata, auditUserRole} {
+		if !containsString(actions, action) {
+			t.Errorf("Expected %s to be recorded, got %v", action, actions)
+		}
+	}
+
+	// The newest event goes first
+	if events[0].Action != auditUserRole || events[0].Target != testGuest.Subject || events[0].Before != "guest" || events[0].After != "user" {
+		t.Errorf("Expected the role change from guest to user, got %+v", events[0])
+	}
+
+	roleChanges, _ := env.server.auditLog.Query(AuditFilter{Action: auditMemberAdd, Namespace: "test-ns"}, 1)
+	if len(roleChanges) != 1 || roleChanges[0].Target != testUser.Subject || roleChanges[0].Before != "viewer" || roleChanges[0].After != "editor" {
+		t.Errorf("Expected the last role change of the member, got %+v", roleChanges)
+	}
+
+	if filtered, _ := env.server.auditLog.Query(AuditFilter{Actor: testGuest.Email}, 0); len(filtered) != 0 {
+		t.Errorf("Expected no events of the guest, got %+v", filtered)
+	}
+	if filtered, _ := env.server.auditLog.Query(AuditFilter{Until: time.Now().Add(-time.Hour)}, 0); len(filtered) != 0 {
+		t.Errorf("Expected no events before the test, got %+v", filtered)
+	}
+
+	// System events have no actor
+	env.server.audit(nil, nil, auditNamespaceArchive, "test-ns", "test-ns", nil, nil)
+	if filtered, _ := env.server.auditLog.Query(AuditFilter{Actor: auditSystemActor}, 0); len(filtered) != 1 || filtered[0].IP != "" {
+		t.Errorf("Expected the system event, got %+v", filtered)
+	}
+
+	if _, body := env.get(client, "/audit?action="+auditMemberAdd); !strings.Contains(body, testUser.Subject) || strings.Contains(body, auditNamespaceArchive+"</td>") {
+		t.Errorf("Expected the filtered events on the page, got %s", body)
+	}
+
+	status, body := env.get(client, "/audit?format=jsonl&namespace=test-ns")
+	if status != http.StatusOK {
+		t.Fatalf("Expected the export, got %d", status)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			t.Fatalf("Expected JSON lines, got %s: %s", body, err.Error())
+		}
+		if event.Namespace != "test-ns" {
+			t.Errorf("Expected only the test-ns events, got %+v", event)
+		}
+		lines++
+	}
+	if lines != 5 {
+		t.Errorf("Expected 5 test-ns events, got %d in %s", lines, body)
+	}
+
+	// Only the admins can read the log
+	if _, body := env.get(env.login(testUser), "/audit?format=jsonl"); strings.Contains(body, testAdmin.Subject) {
+		t.Errorf("Expected the log to be hidden from the users, got %s", body)
+	}
+}
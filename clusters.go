@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	"github.com/gorilla/sessions"
+	"github.com/spf13/viper"
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Cluster is one of the kubernetes clusters served by the portal
+type Cluster struct {
+	Name       string `mapstructure:"name"`
+	Url        string `mapstructure:"url"`        // base domain for the cluster services (grafana, perfsonar, etc)
+	Kubeconfig string `mapstructure:"kubeconfig"` // empty for in-cluster config
+	Context    string `mapstructure:"context"`    // context in kubeconfig, current one if empty
+
+	k8sconfig *rest.Config
+	clientset kubernetes.Interface
+	primary   bool
+
+	// Creates the clientset impersonating the user, overrides the k8sconfig based one when set
+	userClientset func(user *nautilusapi.PRPUser) (kubernetes.Interface, error)
+}
+
+// Reads the clusters list from config and creates the clientsets. The first cluster is the primary one, keeping the PRPUser objects.
+// Falls back to the single cluster named cluster_name, which is the one the portal is running in,
+// or the one from kubeconfig option when running outside of the cluster.
+func loadClusters() ([]*Cluster, error) {
+	clusters := []*Cluster{}
+	if err := viper.UnmarshalKey("clusters", &clusters); err != nil {
+		return nil, err
+	}
+
+	if len(clusters) == 0 {
+		clusters = []*Cluster{{Name: viper.GetString("cluster_name"), Kubeconfig: viper.GetString("kubeconfig")}}
+	}
+
+	for _, cluster := range clusters {
+		if cluster.Name == "" {
+			return nil, fmt.Errorf("Cluster name can't be empty")
+		}
+
+		if cluster.Url == "" {
+			cluster.Url = viper.GetString("cluster_url")
+		}
+
+		var err error
+		if cluster.Kubeconfig == "" {
+			cluster.k8sconfig, err = rest.InClusterConfig()
+		} else {
+			cluster.k8sconfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+				&clientcmd.ClientConfigLoadingRules{ExplicitPath: cluster.Kubeconfig},
+				&clientcmd.ConfigOverrides{CurrentContext: cluster.Context}).ClientConfig()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get the config for cluster %s: %s", cluster.Name, err.Error())
+		}
+
+		if cluster.clientset, err = kubernetes.NewForConfig(cluster.k8sconfig); err != nil {
+			return nil, fmt.Errorf("Failed to create the client for cluster %s: %s", cluster.Name, err.Error())
+		}
+	}
+	return clusters, nil
+}
+
+// Returns the cluster by name, or the primary one for empty name
+func (s *Server) getCluster(name string) *Cluster {
+	if name == "" {
+		return s.clusters[0]
+	}
+	for _, cluster := range s.clusters {
+		if cluster.Name == name {
+			return cluster
+		}
+	}
+	return nil
+}
+
+// Returns the cluster selected by the user
+func (s *Server) getSessionCluster(session *sessions.Session) *Cluster {
+	if name, ok := session.Values["cluster"].(string); ok {
+		if cluster := s.getCluster(name); cluster != nil {
+			return cluster
+		}
+	}
+	return s.clusters[0]
+}
+
+func (cluster *Cluster) IsPrimary() bool {
+	return cluster.primary
+}
+
+// Returns the clientset impersonating the user in the cluster
+func (cluster *Cluster) GetUserClientset(user *nautilusapi.PRPUser) (kubernetes.Interface, error) {
+	if cluster.userClientset != nil {
+		return cluster.userClientset(user)
+	}
+	return user.GetUserClientset(cluster.k8sconfig)
+}
+
+// Check if user can create accounts in the NS - so is he an admin
+func (cluster *Cluster) IsNamespaceAdmin(user *nautilusapi.PRPUser, ns string) bool {
+	userclientset, err := cluster.GetUserClientset(user)
+	if err != nil {
+		return false
+	}
+
+	if rev, err := userclientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authv1.SelfSubjectAccessReview{
+		Spec: authv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authv1.ResourceAttributes{
+				Namespace: ns,
+				Verb:      "create",
+				Group:     "rbac.authorization.k8s.io",
+				Resource:  "rolebindings",
+			},
+		},
+	}); err == nil {
+		return rev.Status.Allowed
+	}
+
+	return false
+}
+
+// Process the /cluster path - switch the current cluster
+func (s *Server) SwitchClusterHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
+	if err != nil {
+		log.Printf("Error getting the session: %s", err.Error())
+	}
+
+	if session.IsNew || session.Values["userid"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if cluster := s.getCluster(r.URL.Query().Get("name")); cluster != nil {
+		session.Values["cluster"] = cluster.Name
+	} else {
+		session.AddFlash(fmt.Sprintf("Unknown cluster %s", r.URL.Query().Get("name")))
+	}
+	session.Save(r, w)
+
+	redirectTo := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Path != "" {
+		redirectTo = ref.RequestURI()
+	}
+	http.Redirect(w, r, redirectTo, http.StatusFound)
+}
@@ -0,0 +1,197 @@
+// nautilus-login is the client-go exec credential plugin getting the OIDC tokens from the Nautilus portal
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthv1alpha1 "k8s.io/client-go/pkg/apis/clientauthentication/v1alpha1"
+)
+
+// Tokens returned by the portal
+type CliToken struct {
+	IDToken      string    `json:"id_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+var portalClient = &http.Client{Timeout: 30 * time.Second}
+
+func main() {
+	portal := flag.String("portal", "", "The portal URL, f.e. https://nautilus.optiputer.net")
+	cacheDir := flag.String("cache-dir", filepath.Join(homeDir(), ".kube", "cache", "nautilus-login"), "Directory to keep the tokens in")
+	loginTimeout := flag.Duration("login-timeout", 5*time.Minute, "Time to wait for the browser login")
+	flag.Parse()
+
+	log.SetFlags(0)
+
+	if *portal == "" {
+		log.Fatal("Please provide the --portal URL")
+	}
+
+	portalUrl, err := url.Parse(*portal)
+	if err != nil {
+		log.Fatalf("Wrong portal URL: %s", err.Error())
+	}
+
+	cacheFile := filepath.Join(*cacheDir, portalUrl.Host+".json")
+
+	token, err := readToken(cacheFile)
+	if err != nil || token.Expiry.Before(time.Now().Add(time.Minute)) {
+		// Try the refresh token first, and fall back to the browser login
+		if token, err = refreshToken(*portal, cacheFile); err != nil {
+			if token, err = browserLogin(*portal, *loginTimeout); err != nil {
+				log.Fatalf("Failed to log in: %s", err.Error())
+			}
+		}
+		if err := writeToken(cacheFile, token); err != nil {
+			log.Printf("Failed to cache the token: %s", err.Error())
+		}
+	}
+
+	expiry := metav1.NewTime(token.Expiry)
+	cred := clientauthv1alpha1.ExecCredential{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "client.authentication.k8s.io/v1alpha1",
+			Kind:       "ExecCredential",
+		},
+		Status: &clientauthv1alpha1.ExecCredentialStatus{
+			Token:               token.IDToken,
+			ExpirationTimestamp: &expiry,
+		},
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(cred); err != nil {
+		log.Fatalf("Failed to write the credential: %s", err.Error())
+	}
+}
+
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	return os.Getenv("USERPROFILE")
+}
+
+func readToken(cacheFile string) (*CliToken, error) {
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	var token CliToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func writeToken(cacheFile string, token *CliToken) error {
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cacheFile, data, 0600)
+}
+
+// Gets the new ID token from the portal using the cached refresh token
+func refreshToken(portal string, cacheFile string) (*CliToken, error) {
+	cached, err := readToken(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	if cached.RefreshToken == "" {
+		return nil, fmt.Errorf("no refresh token")
+	}
+
+	resp, err := portalClient.PostForm(strings.TrimSuffix(portal, "/")+"/refreshToken", url.Values{"refresh_token": {cached.RefreshToken}})
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(resp)
+}
+
+// Runs the OIDC login in the browser. The portal redirects the browser back to the local port with the code to pick up the tokens.
+func browserLogin(portal string, timeout time.Duration) (*CliToken, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	codes := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" || r.URL.Query().Get("code") == "" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("You are logged in. You can close this window now."))
+		select {
+		case codes <- r.URL.Query().Get("code"):
+		default:
+		}
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	loginUrl := fmt.Sprintf("%s/authCli?port=%d", strings.TrimSuffix(portal, "/"), listener.Addr().(*net.TCPAddr).Port)
+	log.Printf("Opening the browser to log in. If it did not open, please go to %s", loginUrl)
+	openBrowser(loginUrl)
+
+	select {
+	case code := <-codes:
+		resp, err := portalClient.Get(fmt.Sprintf("%s/cliToken?code=%s", strings.TrimSuffix(portal, "/"), url.QueryEscape(code)))
+		if err != nil {
+			return nil, err
+		}
+		return decodeToken(resp)
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out waiting for the login")
+	}
+}
+
+func decodeToken(resp *http.Response) (*CliToken, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("portal returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token CliToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func openBrowser(link string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", link)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", link)
+	default:
+		cmd = exec.Command("xdg-open", link)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to open the browser: %s", err.Error())
+	}
+}
@@ -20,4 +20,4 @@ cd ${scriptdir}/vendor/k8s.io/code-generator && ./generate-groups.sh \
   all \
   github.com/dimm0/k8s_portal/pkg/client \
   github.com/dimm0/k8s_portal/pkg/apis \
-  "optiputer.net:v1alpha1" \
+  "optiputer.net:v1alpha1,v1" \
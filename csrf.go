@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// The session value and the form field keeping the CSRF token
+const csrfTokenKey = "csrf_token"
+
+// The header carrying the CSRF token in the javascript requests
+const csrfTokenHeader = "X-CSRF-Token"
+
+// The paths accepting the unsafe methods without the CSRF token. They don't use the session.
+var csrfExemptPaths = []string{"/refreshToken"}
+
+// Returns the CSRF token of the session, creating and saving a new one if there's none yet
+func csrfToken(session *sessions.Session, w http.ResponseWriter, r *http.Request) string {
+	if token, ok := session.Values[csrfTokenKey].(string); ok && token != "" {
+		return token
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Error generating the CSRF token: %s", err.Error())
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	session.Values[csrfTokenKey] = token
+	session.Save(r, w)
+	return token
+}
+
+// Checks the CSRF token of the request form or header against the session one
+func validCsrfToken(session *sessions.Session, r *http.Request) bool {
+	expected, ok := session.Values[csrfTokenKey].(string)
+	if !ok || expected == "" {
+		return false
+	}
+	token := r.PostFormValue(csrfTokenKey)
+	if token == "" {
+		token = r.Header.Get(csrfTokenHeader)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Rejects the requests changing the state which don't carry the CSRF token of the session.
+// The API requests authenticated with the bearer token don't use the session cookie, and are not checked.
+func (s *Server) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") || containsString(csrfExemptPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, err := s.store.Get(r, "prp-session")
+		if err != nil {
+			log.Printf("Error getting the session: %s", err.Error())
+		}
+		if session == nil || !validCsrfToken(session, r) {
+			http.Error(w, "The form has expired, please reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
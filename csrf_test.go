@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutationsNeedCsrfToken(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+
+	// A link can't change anything
+	env.get(client, "/profile?mkns=test-ns")
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Namespace was created with GET: %v", err)
+	}
+
+	for _, token := range []string{"", "forged"} {
+		if status, _ := env.post(client, "/profile", url.Values{"mkns": {"test-ns"}, "csrf_token": {token}}); status != http.StatusForbidden {
+			t.Errorf("Expected the request with token %q to be forbidden, got %d", token, status)
+		}
+	}
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Namespace was created without the CSRF token: %v", err)
+	}
+
+	// Tokens of other sessions are not accepted
+	env.addUser(testUser, "admin")
+	otherToken := env.csrfToken(env.login(testUser))
+	if status, _ := env.post(client, "/profile", url.Values{"mkns": {"test-ns"}, "csrf_token": {otherToken}}); status != http.StatusForbidden {
+		t.Errorf("Expected the request with the token of another session to be forbidden, got %d", status)
+	}
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); err != nil {
+		t.Errorf("Namespace was not created with the CSRF token: %v", err)
+	}
+
+	// The javascript requests send the token in the header
+	req, err := http.NewRequest("POST", env.portal.URL+"/nsMeta", strings.NewReader(url.Values{"pk": {"test-ns"}, "name": {"institution"}, "value": {"UCSD"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(csrfTokenHeader, env.csrfToken(client))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := readTestResponse(t, resp); status != http.StatusOK {
+		t.Errorf("Expected the metadata to be set with the header token, got %d %s", status, body)
+	}
+}
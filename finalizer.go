@@ -0,0 +1,88 @@
+package main
+
+import (
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+func hasUserFinalizer(user *nautilusapi.PRPUser) bool {
+	for _, finalizer := range user.Finalizers {
+		if finalizer == nautilusapi.UserFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the finalizer to the live users, and releases the deleted ones after removing them from the role bindings
+func (s *Server) syncUserFinalizer(user *nautilusapi.PRPUser) error {
+	if user.DeletionTimestamp == nil {
+		if hasUserFinalizer(user) {
+			return nil
+		}
+		return s.updateUserFinalizers(user.Name, func(finalizers []string) []string {
+			return append(finalizers, nautilusapi.UserFinalizer)
+		})
+	}
+
+	if !hasUserFinalizer(user) {
+		return nil
+	}
+	if err := s.cleanupUserBindings(user.Spec.UserID); err != nil {
+		return err
+	}
+	return s.updateUserFinalizers(user.Name, func(finalizers []string) []string {
+		otherFinalizers := []string{}
+		for _, finalizer := range finalizers {
+			if finalizer != nautilusapi.UserFinalizer {
+				otherFinalizers = append(otherFinalizers, finalizer)
+			}
+		}
+		return otherFinalizers
+	})
+}
+
+// Applies the change to the user finalizers, retrying on conflicts. Users already gone are ignored.
+func (s *Server) updateUserFinalizers(name string, change func([]string) []string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		user, err := s.users.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		user.Finalizers = change(user.Finalizers)
+		_, err = s.users.Update(user)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// Deletes the namespace memberships of the user, and removes the user from the portal role bindings in all namespaces
+// and from the cluster user binding in all clusters
+func (s *Server) cleanupUserBindings(userID string) error {
+	memberships, err := s.userMemberships(userID)
+	if err != nil {
+		return err
+	}
+	for _, member := range memberships {
+		if err := s.members.NamespaceMembers(member.Namespace).Delete(member.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	for _, cluster := range s.clusters {
+		if err := removeUserRoleBindings(cluster.clientset, userID); err != nil {
+			return err
+		}
+		if err := removeClusterUserBinding(cluster.clientset, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUserFinalizer(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	user := env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+	if err := env.server.updateClusterUserPrivileges(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.server.syncUserFinalizer(env.getUser(testUser)); err != nil {
+		t.Fatal(err)
+	}
+	user = env.getUser(testUser)
+	if !hasUserFinalizer(user) {
+		t.Fatalf("Expected the finalizer on the user, got %v", user.Finalizers)
+	}
+
+	// The fake clientset deletes right away, so mark the user as being deleted the way the API server does
+	now := metav1.NewTime(time.Now())
+	user.DeletionTimestamp = &now
+	user, err := env.nautilus.OptiputerV1().PRPUsers().Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.server.syncUserFinalizer(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if subjects := env.bindingSubjects("test-ns", "psp:nautilus-user"); containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Deleted user was left in the psp:nautilus-user role binding")
+	}
+	if _, err := env.k8s.Rbac().RoleBindings("test-ns").Get("nautilus-editor", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the empty nautilus-editor role binding to be deleted: %v", err)
+	}
+	if rb, err := env.k8s.Rbac().ClusterRoleBindings().Get("nautilus-cluster-user", metav1.GetOptions{}); err == nil {
+		for _, subj := range rb.Subjects {
+			if subj.Name == testUser.Subject {
+				t.Errorf("Deleted user was left in the nautilus-cluster-user cluster role binding")
+			}
+		}
+	}
+	if user := env.getUser(testUser); hasUserFinalizer(user) {
+		t.Errorf("Expected the finalizer to be released, got %v", user.Finalizers)
+	}
+}
+
+func TestNewUserHasFinalizer(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.login(testGuest)
+	if user := env.getUser(testGuest); !containsString(user.Finalizers, nautilusapi.UserFinalizer) {
+		t.Errorf("Expected the finalizer on the new user, got %v", user.Finalizers)
+	}
+}
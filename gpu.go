@@ -13,43 +13,37 @@ import (
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
 var startTime = time.Now()
 
-var podGpusCache = make(map[types.UID][]string)
-
-var podBothered = make(map[string]string)
-
 var botherSampling = 6 * time.Hour
 
 //https://github.com/zalando-incubator/postgres-operator/blob/master/pkg/cluster/exec.go
-func WatchGpuPods() {
+func (s *Server) WatchGpuPods() {
 
-	if confMap, err := clientset.Core().ConfigMaps("kube-system").Get("pod-bothered", metav1.GetOptions{}); err == nil {
-		podBothered = confMap.Data
+	if confMap, err := s.clientset.Core().ConfigMaps("kube-system").Get("pod-bothered", metav1.GetOptions{}); err == nil {
+		s.podBothered = confMap.Data
 	} else {
 		log.Printf("Error reading the config pod-bothered: %s", err.Error())
 	}
 
 	go func() {
 		for range time.Tick(time.Minute) {
-			if confMap, err := clientset.Core().ConfigMaps("kube-system").Get("pod-bothered", metav1.GetOptions{}); err == nil {
-				confMap.Data = podBothered
-				if _, err := clientset.Core().ConfigMaps("kube-system").Update(confMap); err != nil {
+			if confMap, err := s.clientset.Core().ConfigMaps("kube-system").Get("pod-bothered", metav1.GetOptions{}); err == nil {
+				confMap.Data = s.podBothered
+				if _, err := s.clientset.Core().ConfigMaps("kube-system").Update(confMap); err != nil {
 					log.Printf("Error updating confMap for podsBothered: %s", err.Error())
 				}
 			} else {
-				if _, err := clientset.Core().ConfigMaps("kube-system").Create(&v1.ConfigMap{
+				if _, err := s.clientset.Core().ConfigMaps("kube-system").Create(&v1.ConfigMap{
 					ObjectMeta: metav1.ObjectMeta{
 						Name: "pod-bothered",
 					},
-					Data: podBothered,
+					Data: s.podBothered,
 				}); err != nil {
 					log.Printf("Error submiting confMap for podsBothered: %s", err.Error())
 				}
@@ -59,7 +53,7 @@ func WatchGpuPods() {
 	}()
 
 	lw := cache.NewListWatchFromClient(
-		clientset.Core().RESTClient(),
+		s.clientset.Core().RESTClient(),
 		"pods",
 		v1.NamespaceAll,
 		fields.Everything())
@@ -76,7 +70,7 @@ func WatchGpuPods() {
 					return
 				}
 
-				checkPod(pod)
+				s.checkPod(pod)
 
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -85,8 +79,8 @@ func WatchGpuPods() {
 					log.Printf("Expected Pod but other received %#v", obj)
 					return
 				}
-				delete(podGpusCache, pod.UID)
-				delete(podBothered, string(pod.UID))
+				delete(s.podGpusCache, pod.UID)
+				delete(s.podBothered, string(pod.UID))
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
 				pod, ok := newObj.(*v1.Pod)
@@ -95,7 +89,7 @@ func WatchGpuPods() {
 					return
 				}
 
-				checkPod(pod)
+				s.checkPod(pod)
 			},
 		},
 	)
@@ -107,12 +101,12 @@ func WatchGpuPods() {
 	select {}
 }
 
-func checkPod(pod *v1.Pod) {
+func (s *Server) checkPod(pod *v1.Pod) {
 	if pod.Status.Phase != v1.PodRunning || pod.Status.StartTime.UTC().After(time.Now().Add(time.Duration(-botherSampling))) {
 		return
 	}
 
-	if botheredTimeStr, ok := podBothered[string(pod.UID)]; ok {
+	if botheredTimeStr, ok := s.podBothered[string(pod.UID)]; ok {
 		var botheredTime time.Time
 		if err := botheredTime.UnmarshalText([]byte(botheredTimeStr)); err == nil {
 			if botheredTime.After(time.Now().Add(time.Duration(-botherSampling + time.Minute))) {
@@ -126,12 +120,12 @@ func checkPod(pod *v1.Pod) {
 		res := cont.Resources.Requests["nvidia.com/gpu"]
 		if !res.IsZero() {
 			podGpusCacheArr := []string{}
-			if curGpusArr, ok := podGpusCache[pod.UID]; !ok {
-				if curGpusStr, err := ExecCommand(pod.Name, pod.Namespace, "printenv", "NVIDIA_VISIBLE_DEVICES"); err != nil {
+			if curGpusArr, ok := s.podGpusCache[pod.UID]; !ok {
+				if curGpusStr, err := s.ExecCommand(pod.Name, pod.Namespace, "printenv", "NVIDIA_VISIBLE_DEVICES"); err != nil {
 					log.Printf("Error getting assigned GPUs from pod %s %s : %s", pod.Namespace, pod.Name, err.Error())
 				} else {
 					podGpusCacheArr = strings.Split(strings.TrimSuffix(curGpusStr, "\n"), ",")
-					podGpusCache[pod.UID] = podGpusCacheArr
+					s.podGpusCache[pod.UID] = podGpusCacheArr
 				}
 			} else {
 				podGpusCacheArr = curGpusArr
@@ -172,10 +166,10 @@ func checkPod(pod *v1.Pod) {
 
 			if alert {
 				userEmails := []string{}
-				if userBindings, err := clientset.Rbac().RoleBindings(pod.Namespace).Get("nautilus-admin", metav1.GetOptions{}); err == nil {
+				if userBindings, err := s.clientset.Rbac().RoleBindings(pod.Namespace).Get("nautilus-admin", metav1.GetOptions{}); err == nil {
 					if len(userBindings.Subjects) > 0 {
 						for _, userBinding := range userBindings.Subjects {
-							if user, err := GetUser(userBinding.Name); err == nil {
+							if user, err := s.GetUser(userBinding.Name); err == nil {
 								userEmails = append(userEmails, fmt.Sprintf("%s <%s>", user.Spec.Name, user.Spec.Email))
 							} else {
 								log.Printf("Error getting admins to send emails: %s", err.Error())
@@ -186,10 +180,10 @@ func checkPod(pod *v1.Pod) {
 						log.Printf("No admins found in namespace: %s", pod.Namespace)
 					}
 				}
-				if userBindings, err := clientset.Rbac().RoleBindings(pod.Namespace).Get("nautilus-user", metav1.GetOptions{}); err == nil {
+				if userBindings, err := s.clientset.Rbac().RoleBindings(pod.Namespace).Get("nautilus-user", metav1.GetOptions{}); err == nil {
 					if len(userBindings.Subjects) > 0 {
 						for _, userBinding := range userBindings.Subjects {
-							if user, err := GetUser(userBinding.Name); err == nil {
+							if user, err := s.GetUser(userBinding.Name); err == nil {
 								userEmails = append(userEmails, fmt.Sprintf("%s <%s>", user.Spec.Name, user.Spec.Email))
 							} else {
 								log.Printf("Error getting users to send emails: %s", err.Error())
@@ -201,16 +195,16 @@ func checkPod(pod *v1.Pod) {
 					}
 				}
 				if len(userEmails) > 0 {
-					botherUsersAboutGpus(userEmails, pod, val.(model.Vector))
+					s.botherUsersAboutGpus(userEmails, pod, val.(model.Vector))
 				}
 			}
 		}
 	}
 }
 
-func botherUsersAboutGpus(destination []string, pod *v1.Pod, values model.Vector) {
+func (s *Server) botherUsersAboutGpus(destination []string, pod *v1.Pod, values model.Vector) {
 	if botherTimeBytes, err := time.Now().MarshalText(); err == nil {
-		podBothered[string(pod.UID)] = fmt.Sprintf("%s", botherTimeBytes)
+		s.podBothered[string(pod.UID)] = fmt.Sprintf("%s", botherTimeBytes)
 	}
 	destination = append(destination, "Dmitry Mishin <dmishin@ucsd.edu>")
 	destination = append(destination, "John Graham <jjgraham@ucsd.edu>")
@@ -242,18 +236,18 @@ func botherUsersAboutGpus(destination []string, pod *v1.Pod, values model.Vector
 }
 
 //ExecCommand executes arbitrary command inside the pod
-func ExecCommand(podName string, namespace string, command ...string) (string, error) {
+func (s *Server) ExecCommand(podName string, namespace string, command ...string) (string, error) {
 	var (
 		execOut bytes.Buffer
 		execErr bytes.Buffer
 	)
 
-	pod, err := clientset.Core().Pods(namespace).Get(podName, metav1.GetOptions{})
+	pod, err := s.clientset.Core().Pods(namespace).Get(podName, metav1.GetOptions{})
 	if err != nil {
 		return "", fmt.Errorf("could not get pod info: %v", err)
 	}
 
-	req := clientset.Core().RESTClient().Post().
+	req := s.clientset.Core().RESTClient().Post().
 		Resource("pods").
 		Name(podName).
 		Namespace(namespace).
@@ -265,12 +259,7 @@ func ExecCommand(podName string, namespace string, command ...string) (string, e
 		Stderr:    true,
 	}, scheme.ParameterCodec)
 
-	k8sconfig, err := rest.InClusterConfig()
-	if err != nil {
-		return "", fmt.Errorf("Failed to do inclusterconfig: %v", err)
-	}
-
-	exec, err := remotecommand.NewSPDYExecutor(k8sconfig, "POST", req.URL())
+	exec, err := remotecommand.NewSPDYExecutor(s.clusters[0].k8sconfig, "POST", req.URL())
 	if err != nil {
 		return "", fmt.Errorf("failed to init executor: %v", err)
 	}
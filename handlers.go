@@ -1,19 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
-	"sync"
 	"time"
 
 	authv1 "k8s.io/api/authorization/v1"
 
 	oidc "github.com/coreos/go-oidc"
-	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
 	"github.com/gorilla/sessions"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/tools/clientcmd/api"
@@ -27,19 +28,13 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-//keep config file to be requested later by JS
-var keys = map[string][]byte{}
-
-//OIDC states
-var states = map[string]string{}
-
-var keysLock = sync.RWMutex{}
-var statesLock = sync.RWMutex{}
-
 type IndexTemplateVars struct {
 	User       *nautilusapi.PRPUser
 	ClusterUrl string
+	Cluster    *Cluster
+	Clusters   []*Cluster
 	Flashes    []string
+	CsrfToken  string
 }
 
 type ConfigTemplateVars struct {
@@ -59,18 +54,24 @@ type NodesTemplateVars struct {
 	Nodes []v1.Node
 }
 
-func buildIndexTemplateVars(session *sessions.Session, w http.ResponseWriter, r *http.Request) IndexTemplateVars {
-	returnVars := IndexTemplateVars{User: &nautilusapi.PRPUser{}, ClusterUrl: viper.GetString("cluster_url")}
+func (s *Server) buildIndexTemplateVars(session *sessions.Session, w http.ResponseWriter, r *http.Request) IndexTemplateVars {
+	cluster := s.getSessionCluster(session)
+	returnVars := IndexTemplateVars{User: &nautilusapi.PRPUser{}, ClusterUrl: cluster.Url, Cluster: cluster, Clusters: s.clusters}
 	if session.Values["userid"] == nil {
 		return returnVars
 	}
 
-	if user, err := GetUser(session.Values["userid"].(string)); err != nil {
+	if user, err := s.GetUser(session.Values["userid"].(string)); err != nil {
 		log.Printf("Error getting the user: %s", err.Error())
 	} else {
 		returnVars.User = user
 	}
 
+	// The temporary sessions of the API requests are never saved
+	if !session.IsNew {
+		returnVars.CsrfToken = csrfToken(session, w, r)
+	}
+
 	if flashes := session.Flashes(); len(flashes) > 0 {
 		returnVars.Flashes = []string{}
 		for _, fl := range flashes {
@@ -82,16 +83,66 @@ func buildIndexTemplateVars(session *sessions.Session, w http.ResponseWriter, r
 	return returnVars
 }
 
-func GetUser(userID string) (*nautilusapi.PRPUser, error) {
+// Returns the session of the request. Requests carrying the "Authorization: Bearer <id_token>"
+// header get a temporary session for the token subject, which is never persisted.
+func (s *Server) getSession(r *http.Request) (*sessions.Session, error) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return s.store.Get(r, "prp-session")
+	}
+
+	session := sessions.NewSession(s.store, "prp-session")
+	session.IsNew = true
+	session.Options = &sessions.Options{MaxAge: -1}
+
+	idToken, err := s.verifyIdToken(r.Context(), strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer ")))
+	if err != nil {
+		return session, fmt.Errorf("Failed to verify ID Token: %s", err.Error())
+	}
+
+	if _, err := s.GetUser(idToken.Subject); err != nil {
+		return session, fmt.Errorf("Failed to get the user for ID Token: %s", err.Error())
+	}
+
+	session.Values["userid"] = idToken.Subject
+	session.IsNew = false
+	return session, nil
+}
+
+// Verifies the ID token issued either for the portal or for the kubectl config client
+func (s *Server) verifyIdToken(ctx context.Context, rawIdToken string) (*oidc.IDToken, error) {
+	var err error
+	for _, clientID := range []string{s.config.ClientID, s.pubconfig.ClientID} {
+		var idToken *oidc.IDToken
+		if idToken, err = s.provider.Verifier(&oidc.Config{ClientID: clientID}).Verify(ctx, rawIdToken); err == nil {
+			return idToken, nil
+		}
+	}
+	return nil, err
+}
+
+// Converts the OIDC user ID to the PRPUser object name
+func userObjectName(userID string) string {
 	userName := strings.Replace(userID, "://", "-", -1)
 	userName = strings.Replace(userName, "/", "-", -1)
 	userName = strings.Replace(userName, ".", "-", -1)
+	return strings.ToLower(userName)
+}
 
-	return crdclient.Get(strings.ToLower(userName))
+// Returns the user from the informer cache. Falls back to the API for users not in the cache yet, f.e. just created ones.
+// The returned object is a copy and can be modified.
+func (s *Server) GetUser(userID string) (*nautilusapi.PRPUser, error) {
+	user, err := s.userLister.Get(userObjectName(userID))
+	if apierrors.IsNotFound(err) {
+		return s.users.Get(userObjectName(userID), metav1.GetOptions{})
+	} else if err != nil {
+		return nil, err
+	}
+	return user.DeepCopy(), nil
 }
 
-func RootHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := filestore.Get(r, "prp-session")
+func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -100,7 +151,7 @@ func RootHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		w.Write([]byte(err.Error()))
 	} else {
-		err = t.Execute(w, buildIndexTemplateVars(session, w, r))
+		err = t.Execute(w, s.buildIndexTemplateVars(session, w, r))
 		if err != nil {
 			w.Write([]byte(err.Error()))
 		}
@@ -108,8 +159,8 @@ func RootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 //handles the http requests for configuration file
-func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := filestore.Get(r, "prp-session")
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.store.Get(r, "prp-session")
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -122,13 +173,13 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 //handles the http requests for configuration file
-func GetConfigHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetConfigHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "GET" {
 		return
 	}
 
-	session, err := filestore.Get(r, "prp-session")
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -140,25 +191,27 @@ func GetConfigHandler(w http.ResponseWriter, r *http.Request) {
 
 	id := r.URL.Query().Get("id")
 
-	configFile, ok := keys[id]
+	configFile, ok := s.takeKey(id)
 	if ok {
 		w.Header().Add("Content-Disposition", "attachment; filename=\"config\"")
 		w.Header().Add("Content-Type", "application/yaml")
 		w.Write(configFile)
-		delete(keys, id)
+		if userID, ok := session.Values["userid"].(string); ok {
+			s.recordConfigDownload(userID)
+		}
 	} else {
 		http.Error(w, "Not found", http.StatusNotFound)
 	}
 }
 
 //handles the http requests for get namespace
-func NamespacesHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) NamespacesHandler(w http.ResponseWriter, r *http.Request) {
 
-	if r.Method != "GET" {
+	if r.Method != "GET" && r.Method != "POST" {
 		return
 	}
 
-	session, err := filestore.Get(r, "prp-session")
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -172,27 +225,37 @@ func NamespacesHandler(w http.ResponseWriter, r *http.Request) {
 
 	nss := []v1.Namespace{}
 
-	user, err := GetUser(session.Values["userid"].(string))
+	user, err := s.GetUser(session.Values["userid"].(string))
 	if err != nil {
 		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
-	var reqNsName = r.URL.Query().Get("req")
+	var reqNsName = r.PostFormValue("req")
 	if reqNsName != "" {
-		session.AddFlash(fmt.Sprintf("Requesting the membership is not implemented yet. Please send email to the owner directly."))
+		if err := s.requestMembership(user, reqNsName, r.PostFormValue("comment")); err != nil {
+			session.AddFlash(fmt.Sprintf("Error requesting the membership: %s", err.Error()))
+		} else {
+			s.audit(r, user, auditMembershipRequest, user.Spec.UserID, reqNsName, nil, r.PostFormValue("comment"))
+			session.AddFlash(fmt.Sprintf("Your request to join namespace %s was sent to its admins.", reqNsName))
+		}
 		session.Save(r, w)
+		http.Redirect(w, r, "/namespaces?namespace="+url.QueryEscape(reqNsName), http.StatusSeeOther)
+		return
 	}
 
-	userclientset, err := user.GetUserClientset()
+	cluster := s.getSessionCluster(session)
+
+	userclientset, err := cluster.GetUserClientset(user)
 	if err != nil {
 		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
 	}
 
-	nsList, err := clientset.Core().Namespaces().List(metav1.ListOptions{})
+	nsList, err := cluster.clientset.Core().Namespaces().List(metav1.ListOptions{})
 	if err != nil {
 		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 		session.Save(r, w)
@@ -200,7 +263,7 @@ func NamespacesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	nss = nsList.Items
-	var ns = getUserNamespace(*user)
+	var ns, _ = getUserNamespace(cluster, *user)
 	if r.URL.Query().Get("namespace") != "" {
 		ns = r.URL.Query().Get("namespace")
 	}
@@ -211,7 +274,7 @@ func NamespacesHandler(w http.ResponseWriter, r *http.Request) {
 		session.Save(r, w)
 	}
 
-	stVars := NamespacesTemplateVars{Pods: podsList.Items, Namespaces: nss, Namespace: ns, IndexTemplateVars: buildIndexTemplateVars(session, w, r)}
+	stVars := NamespacesTemplateVars{Pods: podsList.Items, Namespaces: nss, Namespace: ns, IndexTemplateVars: s.buildIndexTemplateVars(session, w, r)}
 
 	t, err := template.New("layout.tmpl").Funcs(template.FuncMap{
 		"hostToIp": hostToIp,
@@ -239,13 +302,13 @@ func hostToIp(host string) string {
 	return ips[0].String()
 }
 
-func NodesHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) NodesHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "GET" {
 		return
 	}
 
-	session, err := filestore.Get(r, "prp-session")
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -255,9 +318,9 @@ func NodesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodesList, _ := clientset.Core().Nodes().List(metav1.ListOptions{})
+	nodesList, _ := s.getSessionCluster(session).clientset.Core().Nodes().List(metav1.ListOptions{})
 
-	stVars := NodesTemplateVars{Nodes: nodesList.Items, IndexTemplateVars: buildIndexTemplateVars(session, w, r)}
+	stVars := NodesTemplateVars{Nodes: nodesList.Items, IndexTemplateVars: s.buildIndexTemplateVars(session, w, r)}
 
 	t, err := template.New("layout.tmpl").Funcs(template.FuncMap{
 		"hostToIp": hostToIp,
@@ -276,12 +339,13 @@ func NodesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getUserNamespace(user nautilusapi.PRPUser) string {
-	if userclientset, err := user.GetUserClientset(); err != nil {
+// Returns the first namespace in the cluster where the user can list pods, and whether one was found
+func getUserNamespace(cluster *Cluster, user nautilusapi.PRPUser) (string, bool) {
+	if userclientset, err := cluster.GetUserClientset(&user); err != nil {
 		log.Printf("Error getting the user clientset: %s", err.Error())
-		return "default"
+		return "default", false
 	} else {
-		if nslist, err := clientset.Core().Namespaces().List(metav1.ListOptions{}); err == nil {
+		if nslist, err := cluster.clientset.Core().Namespaces().List(metav1.ListOptions{}); err == nil {
 			for _, ns := range nslist.Items {
 				if rev, err := userclientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authv1.SelfSubjectAccessReview{
 					Spec: authv1.SelfSubjectAccessReviewSpec{
@@ -294,35 +358,35 @@ func getUserNamespace(user nautilusapi.PRPUser) string {
 					},
 				}); err == nil {
 					if rev.Status.Allowed {
-						return ns.ObjectMeta.Name
+						return ns.ObjectMeta.Name, true
 					}
 				}
 			}
-			return "default"
+			return "default", false
 		} else {
 			log.Printf("Error getting the user namespaces: %s", err.Error())
-			return "default"
+			return "default", false
 		}
 	}
 }
 
-func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "GET" {
 		return
 	}
 
-	session, err := filestore.Get(r, "prp-session")
+	session, err := s.store.Get(r, "prp-session")
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
 
 	var stateVal string
 	handleState := func() {
-		statesLock.Lock()
-		defer statesLock.Unlock()
+		s.statesLock.Lock()
+		defer s.statesLock.Unlock()
 
-		stateValTemp, ok := states[r.URL.Query().Get("state")]
+		stateValTemp, ok := s.states[r.URL.Query().Get("state")]
 		if !ok {
 			http.Error(w, "state did not match", http.StatusBadRequest)
 			return
@@ -331,9 +395,9 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	handleState()
 
-	curConfig := config
-	if stateVal == "config" {
-		curConfig = pubconfig
+	curConfig := s.config
+	if stateVal == "config" || stateVal == "config-exec" || strings.HasPrefix(stateVal, "cli:") {
+		curConfig = s.pubconfig
 	}
 
 	oauth2Token, err := curConfig.Exchange(r.Context(), r.URL.Query().Get("code"))
@@ -345,7 +409,7 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 	oidcConfig := &oidc.Config{
 		ClientID: curConfig.ClientID,
 	}
-	verifier := provider.Verifier(oidcConfig)
+	verifier := s.provider.Verifier(oidcConfig)
 
 	idToken, err := verifier.Verify(r.Context(), oauth2Token.Extra("id_token").(string))
 	if err != nil {
@@ -353,9 +417,14 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if strings.HasPrefix(stateVal, "cli:") {
+		s.issueCliToken(w, r, strings.TrimPrefix(stateVal, "cli:"), oauth2Token, idToken)
+		return
+	}
+
 	switch stateVal {
 	case "auth":
-		userInfo, err := provider.UserInfo(r.Context(), oauth2.StaticTokenSource(oauth2Token))
+		userInfo, err := s.provider.UserInfo(r.Context(), oauth2.StaticTokenSource(oauth2Token))
 		if err != nil {
 			http.Error(w, "Failed to get userinfo: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -377,13 +446,10 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Error getting userInfo from claims %s", err.Error())
 		}
 
-		userName := strings.Replace(userInfo.Subject, "://", "-", -1)
-		userName = strings.Replace(userName, "/", "-", -1)
-		userName = strings.Replace(userName, ".", "-", -1)
-
 		user := &nautilusapi.PRPUser{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: strings.ToLower(userName),
+				Name:       userObjectName(userInfo.Subject),
+				Finalizers: []string{nautilusapi.UserFinalizer},
 			},
 			Spec: nautilusapi.PRPUserSpec{
 				UserID: userInfo.Subject,
@@ -391,7 +457,7 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 				Email:  userInfo.Email,
 				Name:   Claims.Name,
 				IDP:    Claims.IDP,
-				Role:   "guest",
+				Role:   nautilusapi.RoleGuest,
 			},
 		}
 
@@ -404,7 +470,7 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		result, err := crdclient.Create(user)
+		result, err := s.users.Create(user)
 		if err == nil {
 			fmt.Printf("CREATED USER: %#v\n", result)
 		} else if apierrors.IsAlreadyExists(err) {
@@ -412,68 +478,81 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			fmt.Printf("ERROR CREATING USER: %s\n", err.Error())
 		}
+		s.recordUserLogin(userInfo.Subject, Claims.IDP)
 
 		http.Redirect(w, r, "/", http.StatusFound)
-	case "config":
-		clusterInfoConfig, err := clientset.Core().ConfigMaps("kube-public").Get("cluster-info", metav1.GetOptions{})
+	case "config", "config-exec":
+		user, err := s.GetUser(idToken.Subject)
 		if err != nil {
-			http.Error(w, "Failed to get cluster config: "+err.Error(), http.StatusInternalServerError)
-			return
+			log.Printf("Error getting the user: %s", err.Error())
 		}
 
-		co, err := clientcmd.Load([]byte(clusterInfoConfig.Data["kubeconfig"]))
-		clust := *co.Clusters[""]
-		co.Clusters[viper.GetString("cluster_name")] = &clust
-		delete(co.Clusters, "")
+		// Add a context for the primary cluster and for every other cluster the user has namespaces in
+		co := api.NewConfig()
+		for i, cluster := range s.clusters {
+			ns, isMember := "default", false
+			if user != nil {
+				ns, isMember = getUserNamespace(cluster, *user)
+			}
+			if i > 0 && !isMember {
+				continue
+			}
 
-		ns := "default"
-		if user, err := GetUser(idToken.Subject); err != nil {
-			log.Printf("Error getting the user: %s", err.Error())
-		} else {
-			ns = getUserNamespace(*user)
-		}
+			clusterInfoConfig, err := cluster.clientset.Core().ConfigMaps("kube-public").Get("cluster-info", metav1.GetOptions{})
+			if err != nil {
+				http.Error(w, "Failed to get cluster config: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
 
-		co.Contexts = map[string]*api.Context{
-			viper.GetString("cluster_name"): {
-				Cluster:   viper.GetString("cluster_name"),
+			clusterCo, err := clientcmd.Load([]byte(clusterInfoConfig.Data["kubeconfig"]))
+			if err != nil {
+				http.Error(w, "Failed to load cluster config: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			clust := *clusterCo.Clusters[""]
+			co.Clusters[cluster.Name] = &clust
+
+			co.Contexts[cluster.Name] = &api.Context{
+				Cluster:   cluster.Name,
 				AuthInfo:  idToken.Subject,
 				Namespace: ns,
-			},
+			}
 		}
-		co.AuthInfos = map[string]*api.AuthInfo{idToken.Subject: {
-			AuthProvider: &api.AuthProviderConfig{
-				Name: "oidc",
-				Config: map[string]string{
-					"id-token":       oauth2Token.Extra("id_token").(string),
-					"refresh-token":  oauth2Token.RefreshToken,
-					"client-id":      viper.GetString("pub_client_id"),
-					"client-secret":  viper.GetString("pub_client_secret"),
-					"idp-issuer-url": idToken.Issuer,
+
+		if stateVal == "config-exec" {
+			// The nautilus-login plugin gets and refreshes the tokens through the portal
+			co.AuthInfos = map[string]*api.AuthInfo{idToken.Subject: {
+				Exec: &api.ExecConfig{
+					APIVersion: "client.authentication.k8s.io/v1alpha1",
+					Command:    "nautilus-login",
+					Args:       []string{"--portal", "https://" + viper.GetString("cluster_url")},
 				},
-			},
-		}}
-		co.CurrentContext = viper.GetString("cluster_name")
+			}}
+		} else {
+			co.AuthInfos = map[string]*api.AuthInfo{idToken.Subject: {
+				AuthProvider: &api.AuthProviderConfig{
+					Name: "oidc",
+					Config: map[string]string{
+						"id-token":       oauth2Token.Extra("id_token").(string),
+						"refresh-token":  oauth2Token.RefreshToken,
+						"client-id":      viper.GetString("pub_client_id"),
+						"client-secret":  viper.GetString("pub_client_secret"),
+						"idp-issuer-url": idToken.Issuer,
+					},
+				},
+			}}
+		}
+		co.CurrentContext = s.clusters[0].Name
 
 		data, err := runtime.Encode(clientcmdlatest.Codec, co)
 		if err == nil {
-			newId := randStringBytes(16)
-			keysLock.Lock()
-			defer keysLock.Unlock()
-
-			keys[newId] = data
-			cleanKeyTimer := time.NewTimer(time.Second * 5)
-			go func() {
-				<-cleanKeyTimer.C
-				keysLock.Lock()
-				defer keysLock.Unlock()
-				delete(keys, newId)
-			}()
+			newId := s.keepKey(data, time.Second*5)
 
 			t, err := template.ParseFiles("templates/layout.tmpl", "templates/authenticated.tmpl")
 			if err != nil {
 				w.Write([]byte(err.Error()))
 			} else {
-				err = t.Execute(w, ConfigTemplateVars{ConfigId: newId, IndexTemplateVars: buildIndexTemplateVars(session, w, r)})
+				err = t.Execute(w, ConfigTemplateVars{ConfigId: newId, IndexTemplateVars: s.buildIndexTemplateVars(session, w, r)})
 				if err != nil {
 					w.Write([]byte(err.Error()))
 				}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	testAdmin = testIdentity{Subject: "http://cilogon.org/serverA/users/1", Email: "admin@example.com", GivenName: "Admin", FamilyName: "User", IDP: "Test IdP"}
+	testUser  = testIdentity{Subject: "http://cilogon.org/serverA/users/2", Email: "user@example.com", GivenName: "Regular", FamilyName: "User", IDP: "Test IdP"}
+	testGuest = testIdentity{Subject: "http://cilogon.org/serverA/users/3", Email: "guest@example.com", GivenName: "Guest", FamilyName: "User", IDP: "Test IdP"}
+)
+
+func TestLoginCreatesGuestUser(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	client := env.login(testGuest)
+
+	user := env.getUser(testGuest)
+	if user.Spec.Role != "guest" {
+		t.Errorf("Expected the new user to be a guest, got %q", user.Spec.Role)
+	}
+	if user.Spec.UserID != testGuest.Subject || user.Spec.Email != testGuest.Email {
+		t.Errorf("Unexpected user spec %#v", user.Spec)
+	}
+	if user.Spec.Name != "Guest User" {
+		t.Errorf("Expected the name built from the given and family names, got %q", user.Spec.Name)
+	}
+	if user.Spec.ISS != env.issuer.URL {
+		t.Errorf("Expected the issuer %s, got %s", env.issuer.URL, user.Spec.ISS)
+	}
+	if user.Spec.IDP != testGuest.IDP {
+		t.Errorf("Expected the IdP %s, got %s", testGuest.IDP, user.Spec.IDP)
+	}
+	if user.Status.FirstLogin == nil || user.Status.LastLogin == nil || user.Status.LastIDP != testGuest.IDP {
+		t.Errorf("Login was not recorded in the user status %#v", user.Status)
+	}
+
+	if _, body := env.get(client, "/"); !strings.Contains(body, testGuest.Email) {
+		t.Errorf("Expected the home page to show the logged in user")
+	}
+}
+
+func TestLoginKeepsExistingUser(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.login(testAdmin)
+
+	user := env.getUser(testAdmin)
+	if user.Spec.Role != "admin" {
+		t.Errorf("Login changed the user role to %q", user.Spec.Role)
+	}
+	firstLogin := user.Status.FirstLogin
+	if firstLogin == nil {
+		t.Fatalf("First login was not recorded")
+	}
+
+	env.login(testAdmin)
+	if user := env.getUser(testAdmin); !user.Status.FirstLogin.Equal(firstLogin) || user.Status.LastLogin.Before(firstLogin) {
+		t.Errorf("Expected the first login to be kept and the last login updated, got %#v", user.Status)
+	}
+}
+
+func TestNotLoggedInIsRedirected(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	for _, path := range []string{"/profile", "/users", "/namespaces", "/getConfig?id=any"} {
+		resp, err := client.Get(env.portal.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %s", path, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+			t.Errorf("Expected %s to redirect to the home page, got %d %s", path, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestNamespaceCreateDelete(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); err != nil {
+		t.Fatalf("Namespace was not created: %s", err.Error())
+	}
+	if _, err := env.k8s.Core().LimitRanges("test-ns").Get("test-ns-mem", metav1.GetOptions{}); err != nil {
+		t.Errorf("Namespace limits were not created: %s", err.Error())
+	}
+	for _, rbName := range []string{"psp:nautilus-user", "nautilus-admin", "nautilus-admin-ext"} {
+		if subjects := env.bindingSubjects("test-ns", rbName); !containsString(subjects, "User:"+testAdmin.Subject) {
+			t.Errorf("Expected the creator in the %s role binding, got %v", rbName, subjects)
+		}
+	}
+	if user := env.getUser(testAdmin); !containsString(user.Status.Namespaces, "test-ns") {
+		t.Errorf("Expected the namespace in the creator status, got %v", user.Status.Namespaces)
+	}
+
+	if _, body := env.post(client, "/profile", url.Values{"mkns": {"test-ns"}}); !strings.Contains(body, "already exists") {
+		t.Errorf("Expected the error creating the existing namespace")
+	}
+
+	env.post(client, "/nsDelete", url.Values{"namespace": {"test-ns"}, "confirm": {"test-ns"}})
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Namespace was not deleted: %v", err)
+	}
+	if user := env.getUser(testAdmin); containsString(user.Status.Namespaces, "test-ns") {
+		t.Errorf("Deleted namespace was kept in the user status")
+	}
+
+	env.post(client, "/nsDelete", url.Values{"namespace": {"default"}, "confirm": {"default"}})
+	if _, err := env.k8s.Core().Namespaces().Get("default", metav1.GetOptions{}); err != nil {
+		t.Errorf("Standard namespace was deleted: %v", err)
+	}
+}
+
+func TestNamespaceCreateRequiresAdmin(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testUser, "user")
+	client := env.login(testUser)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Namespace was created by a regular user: %v", err)
+	}
+}
+
+func TestNamespaceAddRemoveUser(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+
+	for _, rbName := range []string{"psp:nautilus-user", "nautilus-editor"} {
+		if subjects := env.bindingSubjects("test-ns", rbName); !containsString(subjects, "User:"+testUser.Subject) {
+			t.Errorf("Expected the added user in the %s role binding, got %v", rbName, subjects)
+		}
+	}
+	if subjects := env.bindingSubjects("test-ns", "nautilus-admin"); containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Regular user was added to the admin role binding")
+	}
+	if user := env.getUser(testUser); !containsString(user.Status.Namespaces, "test-ns") {
+		t.Errorf("Expected the namespace in the added user status, got %v", user.Status.Namespaces)
+	}
+
+	_, body := env.get(client, "/users?format=json&action=namespace&namespace=test-ns")
+	if !strings.Contains(body, testUser.Email) {
+		t.Errorf("Expected the added user in the namespace users, got %s", body)
+	}
+
+	env.post(client, "/profile", url.Values{"delusername": {testUser.Subject}, "deluserns": {"test-ns"}})
+
+	if subjects := env.bindingSubjects("test-ns", "psp:nautilus-user"); containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("User was not removed from the psp:nautilus-user role binding, got %v", subjects)
+	}
+	if _, err := env.k8s.Rbac().RoleBindings("test-ns").Get("nautilus-editor", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the empty nautilus-editor role binding to be deleted: %v", err)
+	}
+	if user := env.getUser(testUser); containsString(user.Status.Namespaces, "test-ns") {
+		t.Errorf("Expected the namespace to be removed from the user status")
+	}
+}
+
+func TestValidateUnvalidateUser(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testGuest, "guest")
+	client := env.login(testAdmin)
+
+	if _, body := env.post(client, "/users", url.Values{"user": {testGuest.Subject}, "action": {"validate"}}); body != "user" {
+		t.Errorf("Expected the validated role in the response, got %q", body)
+	}
+	if user := env.getUser(testGuest); user.Spec.Role != "user" {
+		t.Errorf("User was not validated, role %q", user.Spec.Role)
+	}
+	env.waitForUser(testGuest, func(user *nautilusapi.PRPUser) bool { return user.Spec.Role == "user" })
+
+	if _, body := env.post(client, "/users", url.Values{"user": {testGuest.Subject}, "action": {"unvalidate"}}); body != "guest" {
+		t.Errorf("Expected the unvalidated role in the response, got %q", body)
+	}
+	if user := env.getUser(testGuest); user.Spec.Role != "guest" {
+		t.Errorf("User was not unvalidated, role %q", user.Spec.Role)
+	}
+}
+
+func TestValidateRequiresAdmin(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testUser, "user")
+	env.addUser(testGuest, "guest")
+	client := env.login(testUser)
+
+	env.post(client, "/users", url.Values{"user": {testGuest.Subject}, "action": {"validate"}})
+	if user := env.getUser(testGuest); user.Spec.Role != "guest" {
+		t.Errorf("User was validated by a non-admin, role %q", user.Spec.Role)
+	}
+}
+
+func TestClusterPrivilegesInAllClusters(t *testing.T) {
+	failing := fake.NewSimpleClientset()
+	failing.PrependReactor("*", "clusterrolebindings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("cluster is down")
+	})
+	working := fake.NewSimpleClientset()
+	s := &Server{clusters: []*Cluster{{Name: "failing", clientset: failing}, {Name: "working", clientset: working}}}
+
+	user := &nautilusapi.PRPUser{Spec: nautilusapi.PRPUserSpec{UserID: testUser.Subject, Role: "user"}}
+	if err := s.updateClusterUserPrivileges(user); err == nil {
+		t.Errorf("Expected the error of the failing cluster")
+	}
+	// The failing cluster doesn't stop the update of the next one
+	rb, err := working.Rbac().ClusterRoleBindings().Get("nautilus-cluster-user", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rb.Subjects) != 1 || rb.Subjects[0].Name != testUser.Subject {
+		t.Errorf("Expected the user in the nautilus-cluster-user cluster role binding, got %v", rb.Subjects)
+	}
+}
+
+func TestPromoteDemoteUser(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+
+	if _, body := env.post(client, "/users", url.Values{"user": {testUser.Subject}, "action": {"promote"}}); body != "admin" {
+		t.Errorf("Expected the promoted role in the response, got %q", body)
+	}
+	if user := env.getUser(testUser); user.Spec.Role != "admin" {
+		t.Errorf("User was not promoted, role %q", user.Spec.Role)
+	}
+	// The namespace role doesn't follow the global role
+	if subjects := env.bindingSubjects("test-ns", "nautilus-editor"); !containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Expected the promoted user to stay in the nautilus-editor role binding, got %v", subjects)
+	}
+	if subjects := env.bindingSubjects("test-ns", "nautilus-admin"); containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Promoted user was made an admin of the namespace")
+	}
+	env.waitForUser(testUser, func(user *nautilusapi.PRPUser) bool { return user.Spec.Role == "admin" })
+
+	if _, body := env.post(client, "/users", url.Values{"user": {testUser.Subject}, "action": {"demote"}}); body != "user" {
+		t.Errorf("Expected the demoted role in the response, got %q", body)
+	}
+	if user := env.getUser(testUser); user.Spec.Role != "user" {
+		t.Errorf("User was not demoted, role %q", user.Spec.Role)
+	}
+	if subjects := env.bindingSubjects("test-ns", "nautilus-editor"); !containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Expected the demoted user in the nautilus-editor role binding, got %v", subjects)
+	}
+}
+
+func TestNamespaceRoles(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"ns1"}})
+	env.post(client, "/profile", url.Values{"mkns": {"ns2"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"ns1"}, "adduserrole": {"admin"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"ns2"}, "adduserrole": {"editor"}})
+
+	for _, rbName := range []string{"psp:nautilus-user", "nautilus-admin", "nautilus-admin-ext"} {
+		if subjects := env.bindingSubjects("ns1", rbName); !containsString(subjects, "User:"+testUser.Subject) {
+			t.Errorf("Expected the namespace admin in the %s role binding, got %v", rbName, subjects)
+		}
+	}
+	if subjects := env.bindingSubjects("ns2", "nautilus-editor"); !containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Expected the editor in the nautilus-editor role binding, got %v", subjects)
+	}
+	if subjects := env.bindingSubjects("ns2", "nautilus-admin"); containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Editor was added to the nautilus-admin role binding")
+	}
+
+	_, body := env.get(client, "/users?format=json&action=namespace&namespace=ns1")
+	var nsUsers NamespaceUsers
+	if err := json.Unmarshal([]byte(body), &nsUsers); err != nil {
+		t.Fatal(err)
+	}
+	if len(nsUsers.Admins) != 2 || len(nsUsers.Editors) != 0 {
+		t.Errorf("Expected the creator and the user as the admins of ns1, got %s", body)
+	}
+
+	// Changing the role of a member replaces its bindings
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"ns1"}, "adduserrole": {"editor"}})
+	if subjects := env.bindingSubjects("ns1", "nautilus-admin"); containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Former namespace admin was left in the nautilus-admin role binding")
+	}
+	if subjects := env.bindingSubjects("ns1", "nautilus-editor"); !containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Expected the new editor in the nautilus-editor role binding, got %v", subjects)
+	}
+
+	if _, body := env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"ns2"}, "adduserrole": {"owner"}}); !strings.Contains(body, "Unknown namespace role") {
+		t.Errorf("Expected an error for the unknown namespace role")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	user := env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+	if err := env.server.updateClusterUserPrivileges(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, body := env.post(client, "/users", url.Values{"user": {testUser.Subject}, "action": {"delete"}}); status != http.StatusOK {
+		t.Fatalf("Delete failed with %d: %s", status, body)
+	}
+
+	if _, err := env.nautilus.OptiputerV1().PRPUsers().Get(userObjectName(testUser.Subject), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the user to be deleted: %v", err)
+	}
+	if subjects := env.bindingSubjects("test-ns", "psp:nautilus-user"); containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Deleted user was left in the psp:nautilus-user role binding")
+	}
+	if _, err := env.k8s.Rbac().RoleBindings("test-ns").Get("nautilus-editor", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the empty nautilus-editor role binding to be deleted: %v", err)
+	}
+	if subjects := env.bindingSubjects("test-ns", "nautilus-admin"); !containsString(subjects, "User:"+testAdmin.Subject) {
+		t.Errorf("Namespace admin was removed with the deleted user, got %v", subjects)
+	}
+	if rb, err := env.k8s.Rbac().ClusterRoleBindings().Get("nautilus-cluster-user", metav1.GetOptions{}); err == nil {
+		for _, subj := range rb.Subjects {
+			if subj.Name == testUser.Subject {
+				t.Errorf("Deleted user was left in the nautilus-cluster-user cluster role binding")
+			}
+		}
+	}
+}
+
+func TestAdminCantChangeOwnAccount(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+
+	for _, action := range []string{"demote", "delete"} {
+		if status, _ := env.post(client, "/users", url.Values{"user": {testAdmin.Subject}, "action": {action}}); status != http.StatusForbidden {
+			t.Errorf("Expected %s of the own account to be forbidden, got %d", action, status)
+		}
+	}
+	if user := env.getUser(testAdmin); user.Spec.Role != "admin" {
+		t.Errorf("Admin changed their own role to %q", user.Spec.Role)
+	}
+}
+
+var configIdRegexp = regexp.MustCompile(`getConfig\?id=(\w+)`)
+
+func TestKubeconfigDownload(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testUser, "user")
+	client := env.login(testUser)
+
+	for _, authType := range []string{"oidc", "exec"} {
+		_, body := env.get(client, "/authConfig?type="+authType)
+		match := configIdRegexp.FindStringSubmatch(body)
+		if match == nil {
+			t.Fatalf("No config id in the page: %s", body)
+		}
+
+		status, configFile := env.get(client, "/getConfig?id="+match[1])
+		if status != http.StatusOK {
+			t.Fatalf("Config download failed with %d: %s", status, configFile)
+		}
+
+		co, err := clientcmd.Load([]byte(configFile))
+		if err != nil {
+			t.Fatalf("Failed to load the config: %s", err.Error())
+		}
+		if co.CurrentContext != testClusterName {
+			t.Errorf("Expected the current context %s, got %s", testClusterName, co.CurrentContext)
+		}
+		if cluster, ok := co.Clusters[testClusterName]; !ok || cluster.Server != "https://k8s.example.com:6443" {
+			t.Errorf("Expected the cluster from cluster-info, got %#v", co.Clusters)
+		}
+
+		authInfo, ok := co.AuthInfos[testUser.Subject]
+		if !ok {
+			t.Fatalf("No credentials for the user in %#v", co.AuthInfos)
+		}
+		switch authType {
+		case "oidc":
+			if authInfo.AuthProvider == nil || authInfo.AuthProvider.Config["id-token"] == "" ||
+				authInfo.AuthProvider.Config["idp-issuer-url"] != env.issuer.URL ||
+				authInfo.AuthProvider.Config["client-id"] != testPubClientID {
+				t.Errorf("Unexpected oidc auth provider %#v", authInfo.AuthProvider)
+			}
+		case "exec":
+			if authInfo.Exec == nil || authInfo.Exec.Command != "nautilus-login" {
+				t.Errorf("Unexpected exec config %#v", authInfo.Exec)
+			}
+		}
+
+		if user := env.getUser(testUser); user.Status.LastConfigDownload == nil {
+			t.Errorf("Config download was not recorded in the user status")
+		}
+
+		if status, _ := env.get(client, "/getConfig?id="+match[1]); status != http.StatusNotFound {
+			t.Errorf("Expected the config to be downloadable once, got %d", status)
+		}
+	}
+}
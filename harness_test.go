@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	nautilusfake "github.com/dimm0/k8s_portal/pkg/client/clientset/versioned/fake"
+	"github.com/gorilla/sessions"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testClientID    = "portal"
+	testPubClientID = "portal-pub"
+	testClusterName = "test-cluster"
+)
+
+// The identity the stub issuer logs in
+type testIdentity struct {
+	Subject    string `json:"sub"`
+	Email      string `json:"email"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+	IDP        string `json:"idp_name"`
+}
+
+// Stub OIDC issuer with the discovery, authorization, token, userinfo and JWKS endpoints.
+// The authorization endpoint logs in the current identity without asking anything.
+type stubIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	lock     sync.Mutex
+	identity testIdentity
+	codes    map[string]stubGrant
+	tokens   map[string]testIdentity // access and refresh tokens
+}
+
+type stubGrant struct {
+	identity testIdentity
+	clientID string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate the key: %s", err.Error())
+	}
+	issuer := &stubIssuer{key: key, codes: map[string]stubGrant{}, tokens: map[string]testIdentity{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discoveryHandler)
+	mux.HandleFunc("/keys", issuer.keysHandler)
+	mux.HandleFunc("/authorize", issuer.authorizeHandler)
+	mux.HandleFunc("/token", issuer.tokenHandler)
+	mux.HandleFunc("/userinfo", issuer.userinfoHandler)
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+// Sets the identity logged in by the following authorization requests
+func (issuer *stubIssuer) loginAs(identity testIdentity) {
+	issuer.lock.Lock()
+	defer issuer.lock.Unlock()
+	issuer.identity = identity
+}
+
+func (issuer *stubIssuer) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeTestJson(w, map[string]interface{}{
+		"issuer":                                issuer.URL,
+		"authorization_endpoint":                issuer.URL + "/authorize",
+		"token_endpoint":                        issuer.URL + "/token",
+		"userinfo_endpoint":                     issuer.URL + "/userinfo",
+		"jwks_uri":                              issuer.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (issuer *stubIssuer) keysHandler(w http.ResponseWriter, r *http.Request) {
+	writeTestJson(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &issuer.key.PublicKey,
+		KeyID:     "test",
+		Algorithm: "RS256",
+		Use:       "sig",
+	}}})
+}
+
+func (issuer *stubIssuer) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	redirectUrl, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	issuer.lock.Lock()
+	code := randStringBytes(16)
+	issuer.codes[code] = stubGrant{identity: issuer.identity, clientID: r.URL.Query().Get("client_id")}
+	issuer.lock.Unlock()
+
+	query := redirectUrl.Query()
+	query.Set("code", code)
+	query.Set("state", r.URL.Query().Get("state"))
+	redirectUrl.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectUrl.String(), http.StatusFound)
+}
+
+func (issuer *stubIssuer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostFormValue("client_id")
+	}
+
+	issuer.lock.Lock()
+	defer issuer.lock.Unlock()
+
+	var identity testIdentity
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		grant, ok := issuer.codes[r.PostFormValue("code")]
+		if !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		delete(issuer.codes, r.PostFormValue("code"))
+		identity = grant.identity
+	case "refresh_token":
+		if identity, ok = issuer.tokens[r.PostFormValue("refresh_token")]; !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := issuer.signIdToken(identity, clientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken := randStringBytes(16)
+	refreshToken := randStringBytes(16)
+	issuer.tokens[accessToken] = identity
+	issuer.tokens[refreshToken] = identity
+
+	writeTestJson(w, map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"refresh_token": refreshToken,
+		"expires_in":    3600,
+		"id_token":      idToken,
+	})
+}
+
+func (issuer *stubIssuer) userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	issuer.lock.Lock()
+	identity, ok := issuer.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	issuer.lock.Unlock()
+
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeTestJson(w, identity)
+}
+
+// Returns the signed ID token for the identity issued to the client
+func (issuer *stubIssuer) signIdToken(identity testIdentity, clientID string) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: issuer.key}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"iss":   issuer.URL,
+		"sub":   identity.Subject,
+		"aud":   clientID,
+		"email": identity.Email,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
+
+func writeTestJson(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+// Portal running against the fake cluster, the fake CRD clientset and the stub issuer
+type testEnv struct {
+	t        *testing.T
+	server   *Server
+	portal   *httptest.Server
+	issuer   *stubIssuer
+	k8s      *fake.Clientset
+	nautilus *nautilusfake.Clientset
+	stop     chan struct{}
+	auditDir string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	env := &testEnv{
+		t:        t,
+		issuer:   newStubIssuer(t),
+		nautilus: nautilusfake.NewSimpleClientset(),
+		stop:     make(chan struct{}),
+		k8s: fake.NewSimpleClientset(
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-public"}},
+			&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster-info", Namespace: "kube-public"},
+				Data: map[string]string{"kubeconfig": `apiVersion: v1
+kind: Config
+clusters:
+- name: ""
+  cluster:
+    server: https://k8s.example.com:6443
+`},
+			},
+		),
+	}
+
+	env.portal = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.server.ServeHTTP(w, r)
+	}))
+
+	provider, err := oidc.NewProvider(context.Background(), env.issuer.URL)
+	if err != nil {
+		t.Fatalf("Failed to set up the OIDC provider: %s", err.Error())
+	}
+
+	config := oauth2.Config{
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  env.portal.URL + "/callback",
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+	pubconfig := config
+	pubconfig.ClientID = testPubClientID
+
+	viper.Set("cluster_url", strings.TrimPrefix(env.portal.URL, "http://"))
+	viper.Set("pub_client_id", testPubClientID)
+
+	if env.auditDir, err = ioutil.TempDir("", "portal-audit"); err != nil {
+		t.Fatalf("Failed to create the audit log directory: %s", err.Error())
+	}
+	viper.Set("audit_log", filepath.Join(env.auditDir, "audit.log"))
+
+	cluster := &Cluster{Name: testClusterName, clientset: env.k8s}
+	cluster.userClientset = env.userClientset
+
+	env.server = NewServer([]*Cluster{cluster}, env.nautilus,
+		sessions.NewCookieStore([]byte("test-session-key")), provider, config, pubconfig)
+	if err := env.server.StartInformers(env.stop); err != nil {
+		t.Fatalf("Failed to start the informers: %s", err.Error())
+	}
+	return env
+}
+
+func (env *testEnv) Close() {
+	close(env.stop)
+	env.portal.Close()
+	env.issuer.Close()
+	os.RemoveAll(env.auditDir)
+}
+
+// Returns the clientset for the user. It shares the objects with the fake cluster,
+// and answers the access reviews based on the user role and the namespace role bindings.
+func (env *testEnv) userClientset(user *nautilusapi.PRPUser) (kubernetes.Interface, error) {
+	userset := fake.NewSimpleClientset()
+	userset.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := env.k8s.Invokes(action, nil)
+		return true, obj, err
+	})
+	userset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authv1.SelfSubjectAccessReview).DeepCopy()
+		review.Status.Allowed = env.userCan(user, review.Spec.ResourceAttributes)
+		return true, review, nil
+	})
+	return userset, nil
+}
+
+// Cluster admins can do anything, namespace admins can manage the role bindings, and members can do the rest
+func (env *testEnv) userCan(user *nautilusapi.PRPUser, attrs *authv1.ResourceAttributes) bool {
+	if user.Spec.Role == "admin" {
+		return true
+	}
+	if attrs == nil {
+		return false
+	}
+
+	rbs, err := env.k8s.Rbac().RoleBindings(attrs.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return false
+	}
+	for _, rb := range rbs.Items {
+		if attrs.Resource == "rolebindings" && rb.Name != "nautilus-admin" && rb.Name != "nautilus-admin-ext" {
+			continue
+		}
+		for _, subj := range rb.Subjects {
+			if subj.Name == user.Spec.UserID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Adds the user to the store
+func (env *testEnv) addUser(identity testIdentity, role string) *nautilusapi.PRPUser {
+	user, err := env.nautilus.OptiputerV1().PRPUsers().Create(&nautilusapi.PRPUser{
+		ObjectMeta: metav1.ObjectMeta{Name: userObjectName(identity.Subject)},
+		Spec: nautilusapi.PRPUserSpec{
+			UserID: identity.Subject,
+			ISS:    env.issuer.URL,
+			Email:  identity.Email,
+			Name:   identity.GivenName + " " + identity.FamilyName,
+			Role:   role,
+		},
+	})
+	if err != nil {
+		env.t.Fatalf("Failed to add the user: %s", err.Error())
+	}
+	env.waitForUser(identity, func(cached *nautilusapi.PRPUser) bool { return true })
+	return user
+}
+
+// Returns the user from the API
+func (env *testEnv) getUser(identity testIdentity) *nautilusapi.PRPUser {
+	user, err := env.nautilus.OptiputerV1().PRPUsers().Get(userObjectName(identity.Subject), metav1.GetOptions{})
+	if err != nil {
+		env.t.Fatalf("Failed to get the user: %s", err.Error())
+	}
+	return user
+}
+
+// Waits for the users cache of the portal to catch up with the condition
+func (env *testEnv) waitForUser(identity testIdentity, condition func(*nautilusapi.PRPUser) bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if user, err := env.server.userLister.Get(userObjectName(identity.Subject)); err == nil && condition(user) {
+			return
+		}
+	}
+	env.t.Fatalf("Timed out waiting for the user %s in the cache", identity.Subject)
+}
+
+// Returns the browser with the portal session for the identity
+func (env *testEnv) login(identity testIdentity) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		env.t.Fatalf("Failed to create the cookie jar: %s", err.Error())
+	}
+	client := &http.Client{Jar: jar}
+
+	env.issuer.loginAs(identity)
+	if status, body := env.get(client, "/auth"); status != http.StatusOK {
+		env.t.Fatalf("Login failed with %d: %s", status, body)
+	}
+	return client
+}
+
+func (env *testEnv) get(client *http.Client, path string) (int, string) {
+	resp, err := client.Get(env.portal.URL + path)
+	if err != nil {
+		env.t.Fatalf("GET %s failed: %s", path, err.Error())
+	}
+	return readTestResponse(env.t, resp)
+}
+
+// Posts the form with the CSRF token of the client session, unless the values have one
+func (env *testEnv) post(client *http.Client, path string, values url.Values) (int, string) {
+	if _, ok := values["csrf_token"]; !ok {
+		values.Set("csrf_token", env.csrfToken(client))
+	}
+	resp, err := client.PostForm(env.portal.URL+path, values)
+	if err != nil {
+		env.t.Fatalf("POST %s failed: %s", path, err.Error())
+	}
+	return readTestResponse(env.t, resp)
+}
+
+var csrfTokenRegexp = regexp.MustCompile(`name="csrf-token" content="([^"]*)"`)
+
+// Returns the CSRF token of the client session from the page
+func (env *testEnv) csrfToken(client *http.Client) string {
+	_, body := env.get(client, "/")
+	match := csrfTokenRegexp.FindStringSubmatch(body)
+	if match == nil {
+		env.t.Fatalf("No CSRF token on the page: %s", body)
+	}
+	return match[1]
+}
+
+func readTestResponse(t *testing.T, resp *http.Response) (int, string) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read the response: %s", err.Error())
+	}
+	return resp.StatusCode, string(body)
+}
+
+// Returns the subjects of the role binding in the namespace
+func (env *testEnv) bindingSubjects(ns string, name string) []string {
+	rb, err := env.k8s.Rbac().RoleBindings(ns).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	subjects := []string{}
+	for _, subj := range rb.Subjects {
+		subjects = append(subjects, fmt.Sprintf("%s:%s", subj.Kind, subj.Name))
+	}
+	return subjects
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The namespace lifecycle is kept in the namespace annotations
+const (
+	nsExpiresAnnotation  = "optiputer.net/expires"  // the expiration date, in nsExpiresFormat
+	nsRemindedAnnotation = "optiputer.net/reminded" // the days before the expiration of the last reminder sent
+	nsArchivedAnnotation = "optiputer.net/archived" // the time the namespace was archived
+
+	// The replicas of the workloads, or the parallelism of the jobs, before archiving, to restore them on renewal
+	archivedReplicasAnnotation = "optiputer.net/archived-replicas"
+
+	nsExpiresFormat = "2006-01-02"
+
+	// Keeps new pods from starting in the archived namespaces
+	archivedQuotaName = "nautilus-archived"
+)
+
+// The days before the expiration the namespace admins are reminded
+var nsReminderDays = []int{30, 7, 1}
+
+// Returns the expiration date of the namespace, or nil if it doesn't expire
+func nsExpires(ns *v1.Namespace) *time.Time {
+	if expires, err := time.Parse(nsExpiresFormat, ns.Annotations[nsExpiresAnnotation]); err == nil {
+		return &expires
+	}
+	return nil
+}
+
+func nsArchived(ns *v1.Namespace) bool {
+	return ns.Annotations[nsArchivedAnnotation] != ""
+}
+
+// Returns the expiration date of the namespaces created or renewed now, or nil if namespace_expiry_days is 0
+func newNsExpires(now time.Time) *time.Time {
+	days := viper.GetInt("namespace_expiry_days")
+	if days <= 0 {
+		return nil
+	}
+	expires := now.AddDate(0, 0, days)
+	return &expires
+}
+
+// Checks the expiration date set by the namespace admins: not in the past, and not later than a renewal would set it
+func validNsExpires(expires time.Time, now time.Time) error {
+	if expires.Format(nsExpiresFormat) < now.Format(nsExpiresFormat) {
+		return fmt.Errorf("The expiration date can't be in the past")
+	}
+	if latest := newNsExpires(now); latest != nil && expires.Format(nsExpiresFormat) > latest.Format(nsExpiresFormat) {
+		return fmt.Errorf("The expiration date can't be later than %s", latest.Format(nsExpiresFormat))
+	}
+	return nil
+}
+
+// Sets the expiration date of the namespace, allowing new reminders.
+// The archived namespace is restored, unless it's pending deletion.
+func (s *Server) setNsExpires(nsName string, expires time.Time) error {
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if nsArchived(ns) && nsDeleteAfter(ns) == nil {
+		if err := s.unarchiveNamespace(nsName); err != nil {
+			return err
+		}
+		delete(ns.Annotations, nsArchivedAnnotation)
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	ns.Annotations[nsExpiresAnnotation] = expires.Format(nsExpiresFormat)
+	delete(ns.Annotations, nsRemindedAnnotation)
+	_, err = s.clientset.Core().Namespaces().Update(ns)
+	return err
+}
+
+// Sends the reminders for the namespaces expiring soon, and archives the expired ones
+func (s *Server) checkNamespaceExpiry(now time.Time) {
+	nsList, err := s.clientset.Core().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		log.Printf("Error getting the namespaces: %s", err.Error())
+		return
+	}
+
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		expires := nsExpires(ns)
+		if expires == nil || nsArchived(ns) || nsDeleteAfter(ns) != nil || ns.Status.Phase == v1.NamespaceTerminating {
+			continue
+		}
+
+		if !now.Before(*expires) {
+			if err := s.archiveNamespace(ns.Name, now); err != nil {
+				log.Printf("Error archiving namespace %s: %s", ns.Name, err.Error())
+				continue
+			}
+			s.audit(nil, nil, auditNamespaceArchive, ns.Name, ns.Name, map[string]string{"expires": ns.Annotations[nsExpiresAnnotation]}, s.nsAuditState(ns.Name))
+			s.sendNsExpiryMail(ns.Name, *expires, 0)
+			continue
+		}
+
+		daysLeft := int(math.Ceil(expires.Sub(now).Hours() / 24))
+		reminder := 0
+		for _, days := range nsReminderDays {
+			if daysLeft <= days {
+				reminder = days
+			}
+		}
+		if reminder == 0 {
+			continue
+		}
+		if reminded, err := strconv.Atoi(ns.Annotations[nsRemindedAnnotation]); err == nil && reminded <= reminder {
+			continue
+		}
+
+		ns.Annotations[nsRemindedAnnotation] = strconv.Itoa(reminder)
+		if _, err := s.clientset.Core().Namespaces().Update(ns); err != nil {
+			log.Printf("Error updating namespace %s: %s", ns.Name, err.Error())
+			continue
+		}
+		s.sendNsExpiryMail(ns.Name, *expires, daysLeft)
+	}
+}
+
+// Periodically checks the namespaces expiration and the pending deletions, every namespace_expiry_interval
+func (s *Server) WatchNamespaceExpiry(stop <-chan struct{}) {
+	interval := viper.GetDuration("namespace_expiry_interval")
+	if interval <= 0 {
+		log.Printf("Invalid namespace_expiry_interval %q, checking every hour", viper.GetString("namespace_expiry_interval"))
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.checkNamespaceExpiry(time.Now())
+		s.deletePendingNamespaces(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Scales the deployments, stateful sets and running jobs to zero, suspends the cron jobs, deletes the pods without a controller,
+// keeps the new pods from starting, and marks the namespace archived. The data in the volumes is kept.
+func (s *Server) archiveNamespace(nsName string, now time.Time) error {
+	if _, err := s.clientset.Core().ResourceQuotas(nsName).Create(&v1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: archivedQuotaName},
+		Spec:       v1.ResourceQuotaSpec{Hard: v1.ResourceList{v1.ResourcePods: resource.MustParse("0")}},
+	}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	deployments, err := s.clientset.AppsV1().Deployments(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas == 0 {
+			continue
+		}
+		setArchivedReplicas(&deployment.ObjectMeta, *deployment.Spec.Replicas)
+		zero := int32(0)
+		deployment.Spec.Replicas = &zero
+		if _, err := s.clientset.AppsV1().Deployments(nsName).Update(deployment); err != nil {
+			return err
+		}
+	}
+
+	statefulSets, err := s.clientset.AppsV1().StatefulSets(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range statefulSets.Items {
+		statefulSet := &statefulSets.Items[i]
+		if statefulSet.Spec.Replicas == nil || *statefulSet.Spec.Replicas == 0 {
+			continue
+		}
+		setArchivedReplicas(&statefulSet.ObjectMeta, *statefulSet.Spec.Replicas)
+		zero := int32(0)
+		statefulSet.Spec.Replicas = &zero
+		if _, err := s.clientset.AppsV1().StatefulSets(nsName).Update(statefulSet); err != nil {
+			return err
+		}
+	}
+
+	cronJobs, err := s.clientset.BatchV1beta1().CronJobs(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range cronJobs.Items {
+		cronJob := &cronJobs.Items[i]
+		if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend {
+			continue
+		}
+		setArchivedReplicas(&cronJob.ObjectMeta, 1)
+		suspend := true
+		cronJob.Spec.Suspend = &suspend
+		if _, err := s.clientset.BatchV1beta1().CronJobs(nsName).Update(cronJob); err != nil {
+			return err
+		}
+	}
+
+	jobs, err := s.clientset.BatchV1().Jobs(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if job.Status.CompletionTime != nil || (job.Spec.Parallelism != nil && *job.Spec.Parallelism == 0) {
+			continue
+		}
+		parallelism := int32(1) // the default
+		if job.Spec.Parallelism != nil {
+			parallelism = *job.Spec.Parallelism
+		}
+		setArchivedReplicas(&job.ObjectMeta, parallelism)
+		zero := int32(0)
+		job.Spec.Parallelism = &zero
+		if _, err := s.clientset.BatchV1().Jobs(nsName).Update(job); err != nil {
+			return err
+		}
+	}
+
+	// The pods of the controllers are stopped by them, the rest would keep running
+	pods, err := s.clientset.Core().Pods(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		if metav1.GetControllerOf(&pod) != nil {
+			continue
+		}
+		if err := s.clientset.Core().Pods(nsName).Delete(pod.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	ns.Annotations[nsArchivedAnnotation] = now.Format(time.RFC3339)
+	_, err = s.clientset.Core().Namespaces().Update(ns)
+	return err
+}
+
+func setArchivedReplicas(meta *metav1.ObjectMeta, replicas int32) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[archivedReplicasAnnotation] = strconv.Itoa(int(replicas))
+}
+
+// Returns the replicas the workload had before archiving, and whether it was scaled down by the archiving
+func popArchivedReplicas(meta *metav1.ObjectMeta) (int32, bool) {
+	replicas, err := strconv.Atoi(meta.Annotations[archivedReplicasAnnotation])
+	if err != nil {
+		return 0, false
+	}
+	delete(meta.Annotations, archivedReplicasAnnotation)
+	return int32(replicas), true
+}
+
+// Extends the namespace expiration, and restores the workloads of the archived namespace
+func (s *Server) renewNamespace(nsName string, now time.Time) error {
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if nsArchived(ns) {
+		if err := s.unarchiveNamespace(nsName); err != nil {
+			return err
+		}
+		if ns, err = s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{}); err != nil {
+			return err
+		}
+		delete(ns.Annotations, nsArchivedAnnotation)
+	}
+
+	// The renewal period counts from the current expiration if it's not reached yet
+	from := now
+	if expires := nsExpires(ns); expires != nil && expires.After(now) {
+		from = *expires
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	if expires := newNsExpires(from); expires != nil {
+		ns.Annotations[nsExpiresAnnotation] = expires.Format(nsExpiresFormat)
+	} else {
+		delete(ns.Annotations, nsExpiresAnnotation)
+	}
+	delete(ns.Annotations, nsRemindedAnnotation)
+	_, err = s.clientset.Core().Namespaces().Update(ns)
+	return err
+}
+
+func (s *Server) unarchiveNamespace(nsName string) error {
+	if err := s.clientset.Core().ResourceQuotas(nsName).Delete(archivedQuotaName, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	deployments, err := s.clientset.AppsV1().Deployments(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if replicas, ok := popArchivedReplicas(&deployment.ObjectMeta); ok {
+			deployment.Spec.Replicas = &replicas
+			if _, err := s.clientset.AppsV1().Deployments(nsName).Update(deployment); err != nil {
+				return err
+			}
+		}
+	}
+
+	statefulSets, err := s.clientset.AppsV1().StatefulSets(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range statefulSets.Items {
+		statefulSet := &statefulSets.Items[i]
+		if replicas, ok := popArchivedReplicas(&statefulSet.ObjectMeta); ok {
+			statefulSet.Spec.Replicas = &replicas
+			if _, err := s.clientset.AppsV1().StatefulSets(nsName).Update(statefulSet); err != nil {
+				return err
+			}
+		}
+	}
+
+	cronJobs, err := s.clientset.BatchV1beta1().CronJobs(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range cronJobs.Items {
+		cronJob := &cronJobs.Items[i]
+		if _, ok := popArchivedReplicas(&cronJob.ObjectMeta); ok {
+			suspend := false
+			cronJob.Spec.Suspend = &suspend
+			if _, err := s.clientset.BatchV1beta1().CronJobs(nsName).Update(cronJob); err != nil {
+				return err
+			}
+		}
+	}
+
+	jobs, err := s.clientset.BatchV1().Jobs(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if parallelism, ok := popArchivedReplicas(&job.ObjectMeta); ok {
+			job.Spec.Parallelism = &parallelism
+			if _, err := s.clientset.BatchV1().Jobs(nsName).Update(job); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Emails the namespace admins about the expiration. Zero days left means the namespace was archived.
+func (s *Server) sendNsExpiryMail(nsName string, expires time.Time, daysLeft int) {
+	adminEmails := []string{}
+	for _, admin := range s.getNamespaceAdmins(nsName) {
+		if admin.Spec.Email != "" {
+			adminEmails = append(adminEmails, fmt.Sprintf("%s <%s>", admin.Spec.Name, admin.Spec.Email))
+		}
+	}
+	if len(adminEmails) == 0 {
+		log.Printf("Namespace %s has no admins to notify about the expiration", nsName)
+		return
+	}
+
+	subject := fmt.Sprintf("Nautilus cluster: namespace %s expires in %d days", nsName, daysLeft)
+	if daysLeft == 0 {
+		subject = fmt.Sprintf("Nautilus cluster: namespace %s was archived", nsName)
+	}
+	r := NewMailRequest(adminEmails, subject)
+
+	err := r.parseTemplate("templates/expirymail.tmpl", map[string]interface{}{
+		"namespace":  nsName,
+		"expires":    expires.Format(nsExpiresFormat),
+		"daysLeft":   daysLeft,
+		"clusterUrl": viper.GetString("cluster_url"),
+	})
+	if err != nil {
+		log.Printf("Error parsing the email template: %s", err.Error())
+		return
+	}
+	if err := r.sendMail(); err != nil {
+		log.Printf("Failed to send the email to %s : %s\n", r.to, err.Error())
+	} else {
+		log.Printf("Email has been sent to %s\n", r.to)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceExpiry(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	viper.Set("namespace_expiry_days", 365)
+	defer viper.Set("namespace_expiry_days", nil)
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	ns, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := nsExpires(ns)
+	if expires == nil {
+		t.Fatalf("Expected the new namespace to expire, got %v", ns.Annotations)
+	}
+
+	replicas := int32(3)
+	if _, err := env.k8s.AppsV1().Deployments("test-ns").Create(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	parallelism := int32(2)
+	job, err := env.k8s.BatchV1().Jobs("test-ns").Create(&batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "train"},
+		Spec:       batchv1.JobSpec{Parallelism: &parallelism},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	isController := true
+	pods := []*v1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "bare"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "train-1", OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "batch/v1", Kind: "Job", Name: job.Name, UID: job.UID, Controller: &isController},
+		}}},
+	}
+	for _, pod := range pods {
+		if _, err := env.k8s.Core().Pods("test-ns").Create(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reminder is recorded and not repeated
+	env.server.checkNamespaceExpiry(expires.AddDate(0, 0, -20))
+	ns, _ = env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if ns.Annotations[nsRemindedAnnotation] != "30" {
+		t.Errorf("Expected the 30 days reminder, got %v", ns.Annotations)
+	}
+	ns.Annotations[nsRemindedAnnotation] = "7"
+	if _, err := env.k8s.Core().Namespaces().Update(ns); err != nil {
+		t.Fatal(err)
+	}
+	env.server.checkNamespaceExpiry(expires.AddDate(0, 0, -20))
+	if ns, _ = env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); ns.Annotations[nsRemindedAnnotation] != "7" {
+		t.Errorf("Expected the earlier reminder not to be sent after a later one, got %v", ns.Annotations)
+	}
+
+	env.server.checkNamespaceExpiry(expires.Add(time.Hour))
+	ns, _ = env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if !nsArchived(ns) {
+		t.Fatalf("Expected the expired namespace to be archived, got %v", ns.Annotations)
+	}
+	deployment, err := env.k8s.AppsV1().Deployments("test-ns").Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 0 || deployment.Annotations[archivedReplicasAnnotation] != "3" {
+		t.Errorf("Expected the deployment to be scaled down, got %d replicas and %v", *deployment.Spec.Replicas, deployment.Annotations)
+	}
+	if job, _ = env.k8s.BatchV1().Jobs("test-ns").Get("train", metav1.GetOptions{}); *job.Spec.Parallelism != 0 || job.Annotations[archivedReplicasAnnotation] != "2" {
+		t.Errorf("Expected the job to be stopped, got parallelism %d and %v", *job.Spec.Parallelism, job.Annotations)
+	}
+	if _, err := env.k8s.Core().Pods("test-ns").Get("bare", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the pod without a controller to be deleted: %v", err)
+	}
+	// Left to the job controller
+	if _, err := env.k8s.Core().Pods("test-ns").Get("train-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the job pod to be kept: %s", err.Error())
+	}
+	if _, err := env.k8s.Core().ResourceQuotas("test-ns").Get(archivedQuotaName, metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the archive quota: %s", err.Error())
+	}
+
+	env.post(client, "/profile", url.Values{"renewns": {"test-ns"}})
+	ns, _ = env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if nsArchived(ns) {
+		t.Errorf("Expected the renewed namespace to be unarchived, got %v", ns.Annotations)
+	}
+	if renewed := nsExpires(ns); renewed == nil || !renewed.After(time.Now()) {
+		t.Errorf("Expected the expiration to be extended, got %v", ns.Annotations)
+	}
+	if deployment, _ = env.k8s.AppsV1().Deployments("test-ns").Get("web", metav1.GetOptions{}); *deployment.Spec.Replicas != 3 {
+		t.Errorf("Expected the deployment replicas to be restored, got %d", *deployment.Spec.Replicas)
+	}
+	if job, _ = env.k8s.BatchV1().Jobs("test-ns").Get("train", metav1.GetOptions{}); *job.Spec.Parallelism != 2 {
+		t.Errorf("Expected the job parallelism to be restored, got %d", *job.Spec.Parallelism)
+	}
+	if _, err := env.k8s.Core().ResourceQuotas("test-ns").Get(archivedQuotaName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the archive quota to be removed: %v", err)
+	}
+}
+
+func TestNamespaceExpiryBadInterval(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	viper.Set("namespace_expiry_interval", "0")
+	defer viper.Set("namespace_expiry_interval", nil)
+
+	// Returns after the first check instead of panicking
+	stop := make(chan struct{})
+	close(stop)
+	env.server.WatchNamespaceExpiry(stop)
+}
+
+func TestNamespaceExpiresField(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	viper.Set("namespace_expiry_days", 365)
+	defer viper.Set("namespace_expiry_days", nil)
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	for _, value := range []string{time.Now().AddDate(0, 0, -1).Format(nsExpiresFormat), time.Now().AddDate(0, 0, 400).Format(nsExpiresFormat), "9999-12-31"} {
+		if status, _ := env.post(client, "/nsMeta", url.Values{"pk": {"test-ns"}, "name": {"Expires"}, "value": {value}}); status != http.StatusBadRequest {
+			t.Errorf("Expected the expiration date %s to be refused, got %d", value, status)
+		}
+	}
+
+	if err := env.server.archiveNamespace("test-ns", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().AddDate(0, 0, 30).Format(nsExpiresFormat)
+	if status, body := env.post(client, "/nsMeta", url.Values{"pk": {"test-ns"}, "name": {"Expires"}, "value": {expires}}); status != http.StatusOK {
+		t.Fatalf("Expected the expiration date to be set, got %d %s", status, body)
+	}
+	ns, _ := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if ns.Annotations[nsExpiresAnnotation] != expires {
+		t.Errorf("Expected the expiration date %s, got %v", expires, ns.Annotations)
+	}
+	if nsArchived(ns) {
+		t.Errorf("Expected the namespace to be restored with the later expiration date, got %v", ns.Annotations)
+	}
+	if _, err := env.k8s.Core().ResourceQuotas("test-ns").Get(archivedQuotaName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the archive quota to be removed: %v", err)
+	}
+}
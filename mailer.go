@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"path/filepath"
 
 	"github.com/prometheus/common/model"
 	"github.com/spf13/viper"
@@ -25,7 +26,7 @@ func NewMailRequest(to []string, subject string) *MailRequest {
 }
 
 func (r *MailRequest) parseTemplate(fileName string, data interface{}) error {
-	t, err := template.New("gpumail.tmpl").Funcs(template.FuncMap{
+	t, err := template.New(filepath.Base(fileName)).Funcs(template.FuncMap{
 		"getLabel": func(metr model.Metric, label string) string {
 			return fmt.Sprintf("%s", metr[model.LabelName(label)])
 		},
@@ -36,7 +37,7 @@ func (r *MailRequest) parseTemplate(fileName string, data interface{}) error {
 	}
 
 	buffer := new(bytes.Buffer)
-	if err = t.ExecuteTemplate(buffer, "gpumail.tmpl", data); err != nil {
+	if err = t.ExecuteTemplate(buffer, filepath.Base(fileName), data); err != nil {
 		return err
 	}
 	r.body = buffer.String()
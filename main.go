@@ -9,19 +9,22 @@ import (
 	"path"
 	"time"
 
-	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	nautilusv1alpha1api "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	nautilusclientset "github.com/dimm0/k8s_portal/pkg/client/clientset/versioned"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	apiextcs "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/gorilla/sessions"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -29,14 +32,6 @@ import (
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-var config oauth2.Config
-var pubconfig oauth2.Config
-var provider *oidc.Provider
-var clientset *kubernetes.Clientset
-var filestore *sessions.FilesystemStore
-
-var crdclient *nautilusapi.CrdClient
-
 func randStringBytes(n int) string {
 	b := make([]byte, n)
 	for i := range b {
@@ -53,6 +48,20 @@ func main() {
 
 	viper.SetDefault("cluster_name", "kubernetes")
 	viper.SetDefault("storage_path", "/")
+	viper.SetDefault("rbac_reconcile", "report")
+	viper.SetDefault("rbac_reconcile_interval", "10m")
+	viper.SetDefault("namespace_expiry_days", 365)
+	viper.SetDefault("namespace_expiry_interval", "1h")
+	viper.SetDefault("namespace_deletion_grace", "72h")
+	viper.SetDefault("webhook_addr", ":8443")
+	viper.SetDefault("webhook_namespace", "kube-system")
+	viper.SetDefault("webhook_privileged_users", []string{"system:serviceaccount:kube-system:nautilus-portal"})
+
+	pflag.String("kubeconfig", "", "Path to the kubeconfig file, for running outside of the cluster")
+	pflag.String("listen_addr", ":80", "Address to listen on")
+	pflag.Parse()
+	viper.BindPFlag("kubeconfig", pflag.Lookup("kubeconfig"))
+	viper.BindPFlag("listen_addr", pflag.Lookup("listen_addr"))
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -60,7 +69,8 @@ func main() {
 	}
 
 	os.Mkdir(path.Join(viper.GetString("storage_path"), "sessions"), 0777)
-	filestore = sessions.NewFilesystemStore(path.Join(viper.GetString("storage_path"), "sessions"), []byte(viper.GetString("session_auth_key")), []byte(viper.GetString("session_enc_key")))
+	viper.SetDefault("audit_log", path.Join(viper.GetString("storage_path"), "audit.log"))
+	filestore := sessions.NewFilesystemStore(path.Join(viper.GetString("storage_path"), "sessions"), []byte(viper.GetString("session_auth_key")), []byte(viper.GetString("session_enc_key")))
 
 	filestore.Options.Domain = viper.GetString("cluster_url")
 	filestore.Options.Secure = true
@@ -68,11 +78,11 @@ func main() {
 	filestore.Options.MaxAge = 86400 * 7
 	filestore.Options.HttpOnly = true
 
-	provider, err = oidc.NewProvider(ctx, viper.GetString("oidc_provider"))
+	provider, err := oidc.NewProvider(ctx, viper.GetString("oidc_provider"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	config = oauth2.Config{
+	config := oauth2.Config{
 		ClientID:     viper.GetString("client_id"),
 		ClientSecret: viper.GetString("client_secret"),
 		Endpoint:     provider.Endpoint(),
@@ -80,7 +90,7 @@ func main() {
 		Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "org.cilogon.userinfo"},
 	}
 
-	pubconfig = oauth2.Config{
+	pubconfig := oauth2.Config{
 		ClientID:     viper.GetString("pub_client_id"),
 		ClientSecret: viper.GetString("pub_client_secret"),
 		Endpoint:     provider.Endpoint(),
@@ -88,92 +98,91 @@ func main() {
 		Scopes:       []string{oidc.ScopeOpenID},
 	}
 
-	k8sconfig, err := rest.InClusterConfig()
+	clusters, err := loadClusters()
 	if err != nil {
-		log.Fatal("Failed to do inclusterconfig: " + err.Error())
+		log.Fatal("Failed to set up the clusters: " + err.Error())
 		return
 	}
 
-	clientset, err = kubernetes.NewForConfig(k8sconfig)
+	// The primary cluster keeps the users and runs the GPU monitoring
+	crdclientset, err := apiextcs.NewForConfig(clusters[0].k8sconfig)
 	if err != nil {
-		log.Printf("Error creating client: %s", err.Error())
+		panic(err.Error())
+	}
+
+	if err := nautilusapi.CreateCRD(crdclientset); err != nil {
+		log.Printf("Error creating CRD: %s", err.Error())
 	}
 
-	// Create a new clientset which include our CRD schema
-	crdcs, scheme, err := nautilusapi.NewClient(k8sconfig)
+	if err := nautilusv1alpha1api.CreateCRD(crdclientset); err != nil {
+		log.Printf("Error creating CRD: %s", err.Error())
+	}
+
+	// Create the clientset for our CRDs
+	nautilusClientset, err := nautilusclientset.NewForConfig(clusters[0].k8sconfig)
 	if err != nil {
-		log.Printf("Error creating CRD client: %s", err.Error())
+		log.Fatal("Failed to create the CRD client: " + err.Error())
 	}
 
-	// Create a CRD client interface
-	crdclient = nautilusapi.MakeCrdClient(crdcs, scheme, "default")
-
-	SetupSecurity()
-
-	http.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir("/media"))))
-
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "/media/favicon.ico")
-	})
-
-	http.HandleFunc("/", RootHandler)
-	http.HandleFunc("/namespaces", NamespacesHandler)
-	http.HandleFunc("/nodes", NodesHandler)
-	http.HandleFunc("/profile", ProfileHandler)
-	http.HandleFunc("/nsMeta", NsMetaHandler)
-	http.HandleFunc("/tests", TestsHandler)
-
-	http.HandleFunc("/authConfig", func(w http.ResponseWriter, r *http.Request) {
-		statesLock.Lock()
-		defer statesLock.Unlock()
-
-		newState := randStringBytes(36)
-		states[newState] = "config"
-		cleanStateTimer := time.NewTimer(time.Minute * 10)
-		go func() {
-			<-cleanStateTimer.C
-			statesLock.Lock()
-			defer statesLock.Unlock()
-			delete(states, newState)
-		}()
-		http.Redirect(w, r, pubconfig.AuthCodeURL(newState), http.StatusFound)
-	})
-
-	http.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
-		statesLock.Lock()
-		defer statesLock.Unlock()
-
-		newState := randStringBytes(36)
-		states[newState] = "auth"
-		cleanStateTimer := time.NewTimer(time.Minute * 10)
-		go func() {
-			<-cleanStateTimer.C
-			statesLock.Lock()
-			defer statesLock.Unlock()
-			delete(states, newState)
-		}()
-		http.Redirect(w, r, config.AuthCodeURL(newState), http.StatusFound)
-	})
-
-	http.HandleFunc("/getConfig", GetConfigHandler)
-	http.HandleFunc("/callback", AuthenticateHandler)
-	http.HandleFunc("/users", UsersHandler)
-	http.HandleFunc("/logout", LogoutHandler)
-
-	log.Printf("listening on http://%s/", "127.0.0.1")
+	server := NewServer(clusters, nautilusClientset, filestore, provider, config, pubconfig)
 
-	go func() {
-		GetCrd()
-	}()
+	// The webhook guards the users roles, and should be up before the users are migrated
+	if viper.GetString("webhook_service") != "" {
+		if err := server.StartWebhook(); err != nil {
+			log.Printf("Error setting up the admission webhook: %s", err.Error())
+		}
+	} else {
+		log.Printf("webhook_service is not set, the users are not guarded by the admission webhook")
+	}
+
+	// Wait for the CRDs to be created before we use them (only needed if they're new ones)
+	time.Sleep(3 * time.Second)
+
+	if err := migrateUsers(nautilusClientset); err != nil {
+		log.Printf("Error migrating the users to %s: %s", nautilusapi.CRDVersion, err.Error())
+	}
+
+	if err := migrateMembers(nautilusClientset); err != nil {
+		log.Printf("Error migrating the namespace members: %s", err.Error())
+	}
+
+	// The namespace members are created from the existing role bindings before the controller starts syncing them
+	if err := server.importNamespaceMembers(); err != nil {
+		log.Printf("Error importing the namespace members: %s", err.Error())
+	}
+
+	if err := server.importNsMetadata(); err != nil {
+		log.Printf("Error importing the namespace metadata: %s", err.Error())
+	}
+
+	for _, cluster := range clusters {
+		if err := SetupSecurity(cluster.clientset); err != nil {
+			log.Printf("Error setting up security in cluster %s: %s", cluster.Name, err.Error())
+		}
+	}
+
+	server.WatchUsers()
+	server.WatchMembers()
+
+	stop := make(chan struct{})
+	if err := server.StartInformers(stop); err != nil {
+		log.Fatal(err)
+	}
 
 	go func() {
-		WatchGpuPods()
+		server.WatchGpuPods()
 	}()
 
-	log.Fatal(http.ListenAndServe(":80", nil))
+	go server.WatchRBAC(stop)
+
+	go server.WatchNamespaceExpiry(stop)
+
+	log.Printf("listening on http://%s/", viper.GetString("listen_addr"))
+
+	log.Fatal(http.ListenAndServe(viper.GetString("listen_addr"), server))
 }
 
-func SetupSecurity() error {
+func SetupSecurity(clientset kubernetes.Interface) error {
 	if _, err := clientset.Extensions().PodSecurityPolicies().Get("nautilususerpolicy", metav1.GetOptions{}); err != nil {
 		f := false
 		if _, err := clientset.Extensions().PodSecurityPolicies().Create(&v1beta1.PodSecurityPolicy{
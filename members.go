@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Marks the namespaces which role bindings were imported as members
+const membersImportedAnnotation = "optiputer.net/members-imported"
+
+// Keeps the namespace role bindings in sync with the NamespaceMember objects from the shared informer
+func (s *Server) WatchMembers() {
+	s.memberInformer.AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				member, ok := obj.(*nautilusapi.NamespaceMember)
+				if !ok {
+					log.Printf("Expected NamespaceMember but other received %#v", obj)
+					return
+				}
+
+				s.syncNamespaceBindingsLogged(member.Namespace)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				member, ok := newObj.(*nautilusapi.NamespaceMember)
+				if !ok {
+					log.Printf("Expected NamespaceMember but other received %#v", newObj)
+					return
+				}
+
+				// Also runs on the informer resync, repairing the bindings edited by hand
+				s.syncNamespaceBindingsLogged(member.Namespace)
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				member, ok := obj.(*nautilusapi.NamespaceMember)
+				if !ok {
+					log.Printf("Expected NamespaceMember but other received %#v", obj)
+					return
+				}
+
+				s.syncNamespaceBindingsLogged(member.Namespace)
+			},
+		},
+	)
+}
+
+func (s *Server) syncNamespaceBindingsLogged(nsName string) {
+	if err := s.syncNamespaceBindings(nsName); err != nil {
+		log.Printf("Error syncing the role bindings of namespace %s: %s", nsName, err.Error())
+	}
+}
+
+// Makes the portal role bindings in the namespace match its members. Guests get no bindings until they're validated.
+func (s *Server) syncNamespaceBindings(nsName string) error {
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if ns.Status.Phase == v1.NamespaceTerminating {
+		return nil
+	}
+
+	membersList, err := s.members.NamespaceMembers(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	desired := map[string][]string{}
+	for _, member := range membersList.Items {
+		if member.DeletionTimestamp != nil {
+			continue
+		}
+		// Not from the cache: the bindings are synced right after the user role changes
+		if user, err := s.users.Get(userObjectName(member.Spec.UserID), metav1.GetOptions{}); err == nil {
+			if user.IsGuest() || user.DeletionTimestamp != nil {
+				continue
+			}
+		} else if !apierrors.IsNotFound(err) {
+			return err
+		}
+		for _, rbName := range memberRoleBindings(member.Spec.Role) {
+			desired[rbName] = append(desired[rbName], member.Spec.UserID)
+		}
+	}
+
+	for _, rbName := range nsRoleBindingNames {
+		if err := syncRoleBinding(s.clientset, nsName, rbName, desired[rbName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The namespace roles that can be given to members
+var namespaceRoles = []string{nautilusapi.NamespaceRoleViewer, nautilusapi.NamespaceRoleEditor, nautilusapi.NamespaceRoleAdmin}
+
+func isNamespaceRole(role string) bool {
+	for _, nsRole := range namespaceRoles {
+		if nsRole == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the user to the namespace with the role, or changes the role of the existing member
+func (s *Server) addNamespaceMember(nsName string, user *nautilusapi.PRPUser, role string) error {
+	member := &nautilusapi.NamespaceMember{
+		ObjectMeta: metav1.ObjectMeta{Name: userObjectName(user.Spec.UserID)},
+		Spec: nautilusapi.NamespaceMemberSpec{
+			UserID: user.Spec.UserID,
+			Role:   role,
+		},
+	}
+
+	_, err := s.members.NamespaceMembers(nsName).Create(member)
+	if apierrors.IsAlreadyExists(err) {
+		var existing *nautilusapi.NamespaceMember
+		if existing, err = s.members.NamespaceMembers(nsName).Get(member.Name, metav1.GetOptions{}); err == nil && existing.Spec != member.Spec {
+			existing.Spec = member.Spec
+			_, err = s.members.NamespaceMembers(nsName).Update(existing)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.syncNamespaceBindings(nsName)
+}
+
+// Removes the user from the namespace
+func (s *Server) removeNamespaceMember(nsName string, userID string) error {
+	if err := s.members.NamespaceMembers(nsName).Delete(userObjectName(userID), &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return s.syncNamespaceBindings(nsName)
+}
+
+// Returns the role of the user in the namespace, or empty string if the user is not a member
+func (s *Server) namespaceMemberRole(nsName string, userID string) string {
+	member, err := s.members.NamespaceMembers(nsName).Get(userObjectName(userID), metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+	return member.Spec.Role
+}
+
+// Returns the namespace memberships of the user
+func (s *Server) userMemberships(userID string) ([]nautilusapi.NamespaceMember, error) {
+	membersList, err := s.members.NamespaceMembers("").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	memberships := []nautilusapi.NamespaceMember{}
+	for _, member := range membersList.Items {
+		if member.Spec.UserID == userID {
+			memberships = append(memberships, member)
+		}
+	}
+	return memberships, nil
+}
+
+// Creates the members of every namespace from its nautilus-admin and nautilus-user role bindings.
+// Each namespace is imported once, so that the later edits of the bindings are reverted instead of imported.
+func (s *Server) importNamespaceMembers() error {
+	nsList, err := s.clientset.Core().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		if ns.Annotations[membersImportedAnnotation] != "" || ns.Status.Phase == v1.NamespaceTerminating {
+			continue
+		}
+
+		imported := map[string]bool{}
+		failed := false
+		for _, rbName := range []string{"nautilus-admin", "nautilus-user"} {
+			role := nautilusapi.NamespaceRoleEditor
+			if rbName == "nautilus-admin" {
+				role = nautilusapi.NamespaceRoleAdmin
+			}
+			rb, err := s.clientset.Rbac().RoleBindings(ns.Name).Get(rbName, metav1.GetOptions{})
+			if err != nil {
+				continue
+			}
+			for _, subj := range rb.Subjects {
+				if subj.Kind != "User" || imported[subj.Name] {
+					continue
+				}
+				imported[subj.Name] = true
+				if _, err := s.members.NamespaceMembers(ns.Name).Create(&nautilusapi.NamespaceMember{
+					ObjectMeta: metav1.ObjectMeta{Name: userObjectName(subj.Name)},
+					Spec: nautilusapi.NamespaceMemberSpec{
+						UserID: subj.Name,
+						Role:   role,
+					},
+				}); err != nil && !apierrors.IsAlreadyExists(err) {
+					log.Printf("Error importing member %s of namespace %s: %s", subj.Name, ns.Name, err.Error())
+					failed = true
+				}
+			}
+		}
+
+		if failed {
+			continue
+		}
+		if ns.Annotations == nil {
+			ns.Annotations = map[string]string{}
+		}
+		ns.Annotations[membersImportedAnnotation] = "true"
+		if _, err := s.clientset.Core().Namespaces().Update(ns); err != nil {
+			log.Printf("Error marking namespace %s as imported: %s", ns.Name, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImportNamespaceMembers(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+
+	if _, err := env.k8s.Core().Namespaces().Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "legacy-ns"}}); err != nil {
+		t.Fatal(err)
+	}
+	for rbName, userID := range map[string]string{"nautilus-admin": testAdmin.Subject, "nautilus-user": testUser.Subject} {
+		if _, err := env.k8s.Rbac().RoleBindings("legacy-ns").Create(&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: rbName},
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: nsRoleBindingRoles[rbName]},
+			Subjects:   []rbacv1.Subject{{Kind: "User", APIGroup: "rbac.authorization.k8s.io", Name: userID}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := env.server.importNamespaceMembers(); err != nil {
+		t.Fatal(err)
+	}
+
+	nsUsers, err := env.server.getNamespaceUsers("legacy-ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nsUsers.Admins) != 1 || nsUsers.Admins[0].Spec.UserID != testAdmin.Subject {
+		t.Errorf("Expected the imported admin, got %v", nsUsers.Admins)
+	}
+	if len(nsUsers.Editors) != 1 || nsUsers.Editors[0].Spec.UserID != testUser.Subject {
+		t.Errorf("Expected the imported user, got %v", nsUsers.Editors)
+	}
+
+	ns, err := env.k8s.Core().Namespaces().Get("legacy-ns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Annotations[membersImportedAnnotation] == "" {
+		t.Errorf("Expected the namespace to be marked as imported, got %v", ns.Annotations)
+	}
+
+	// The editors move from the binding named after the global role
+	if err := env.server.syncNamespaceBindings("legacy-ns"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.k8s.Rbac().RoleBindings("legacy-ns").Get("nautilus-user", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the nautilus-user role binding to be deleted: %v", err)
+	}
+	if subjects := env.bindingSubjects("legacy-ns", "nautilus-editor"); !containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Expected the imported user in the nautilus-editor role binding, got %v", subjects)
+	}
+
+	// Users added to the bindings by hand after the import are not members
+	if err := env.server.removeNamespaceMember("legacy-ns", testUser.Subject); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.server.importNamespaceMembers(); err != nil {
+		t.Fatal(err)
+	}
+	if nsUsers, err := env.server.getNamespaceUsers("legacy-ns"); err != nil || len(nsUsers.Editors) != 0 {
+		t.Errorf("Expected the namespace to be imported only once, got %v %v", nsUsers.Editors, err)
+	}
+}
+
+func TestSyncRestoresBindings(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+
+	rb, err := env.k8s.Rbac().RoleBindings("test-ns").Get("nautilus-editor", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb.Subjects = []rbacv1.Subject{{Kind: "User", APIGroup: "rbac.authorization.k8s.io", Name: "intruder"}}
+	if _, err := env.k8s.Rbac().RoleBindings("test-ns").Update(rb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.server.syncNamespaceBindings("test-ns"); err != nil {
+		t.Fatal(err)
+	}
+
+	subjects := env.bindingSubjects("test-ns", "nautilus-editor")
+	if !containsString(subjects, "User:"+testUser.Subject) || containsString(subjects, "User:intruder") {
+		t.Errorf("Expected the binding to be restored from the members, got %v", subjects)
+	}
+	if subjects := env.bindingSubjects("test-ns", "psp:nautilus-user"); !containsString(subjects, "ServiceAccount:default") {
+		t.Errorf("Expected the default service account to be kept in the psp binding, got %v", subjects)
+	}
+}
+
+func TestGuestMemberHasNoBindings(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	guest := env.addUser(testGuest, "guest")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	if err := env.server.addNamespaceMember("test-ns", guest, nautilusapi.NamespaceRoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := env.bindingSubjects("test-ns", "psp:nautilus-user"); containsString(subjects, "User:"+testGuest.Subject) {
+		t.Errorf("Guest got the namespace bindings: %v", subjects)
+	}
+
+	if _, err := env.server.changeUserRole(env.getUser(testGuest), nautilusapi.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := env.bindingSubjects("test-ns", "nautilus-editor"); !containsString(subjects, "User:"+testGuest.Subject) {
+		t.Errorf("Expected the validated member in the namespace bindings, got %v", subjects)
+	}
+}
+
+func TestViewerRole(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"viewer"}})
+
+	rb, err := env.k8s.Rbac().RoleBindings("test-ns").Get("nautilus-viewer", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.RoleRef.Kind != "ClusterRole" || rb.RoleRef.Name != "view" {
+		t.Errorf("Expected the nautilus-viewer role binding to the view cluster role, got %v", rb.RoleRef)
+	}
+	if subjects := env.bindingSubjects("test-ns", "nautilus-viewer"); !containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Expected the viewer in the nautilus-viewer role binding, got %v", subjects)
+	}
+	for _, rbName := range []string{"psp:nautilus-user", "nautilus-editor", "nautilus-admin"} {
+		if subjects := env.bindingSubjects("test-ns", rbName); containsString(subjects, "User:"+testUser.Subject) {
+			t.Errorf("Viewer was added to the %s role binding", rbName)
+		}
+	}
+
+	_, body := env.get(client, "/users?format=json&action=namespace&namespace=test-ns")
+	var nsUsers NamespaceUsers
+	if err := json.Unmarshal([]byte(body), &nsUsers); err != nil {
+		t.Fatal(err)
+	}
+	if len(nsUsers.Viewers) != 1 || nsUsers.Viewers[0].Spec.UserID != testUser.Subject {
+		t.Errorf("Expected the viewer in the namespace members, got %s", body)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	nautilusv1alpha1api "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	"github.com/spf13/viper"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type MembershipTemplateVars struct {
+	IndexTemplateVars
+	Requests []MembershipRequestItem
+}
+
+type MembershipRequestItem struct {
+	Request nautilusv1alpha1api.NamespaceMembershipRequest
+	User    nautilusapi.PRPUser
+}
+
+// Creates a new membership request and notifies the namespace admins
+func (s *Server) requestMembership(user *nautilusapi.PRPUser, nsName string, comment string) error {
+	if user.IsGuest() {
+		return fmt.Errorf("your account has to be validated by an admin first")
+	}
+
+	if _, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{}); err != nil {
+		return err
+	}
+
+	admins := s.getNamespaceAdmins(nsName)
+	if len(admins) == 0 {
+		return fmt.Errorf("no admins found in namespace %s", nsName)
+	}
+
+	req := &nautilusv1alpha1api.NamespaceMembershipRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: nsName + "-" + userObjectName(user.Spec.UserID),
+		},
+		Spec: nautilusv1alpha1api.NamespaceMembershipRequestSpec{
+			Namespace: nsName,
+			UserID:    user.Spec.UserID,
+			Comment:   comment,
+			State:     "pending",
+		},
+	}
+
+	if _, err := s.membershipRequests.Create(req); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		existing, err := s.membershipRequests.Get(req.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if existing.IsPending() {
+			return fmt.Errorf("you already have a pending request for namespace %s", nsName)
+		}
+		// Resubmit the previously reviewed request
+		existing.Spec = req.Spec
+		if _, err := s.membershipRequests.Update(existing); err != nil {
+			return err
+		}
+	}
+
+	adminEmails := []string{}
+	for _, admin := range admins {
+		adminEmails = append(adminEmails, fmt.Sprintf("%s <%s>", admin.Spec.Name, admin.Spec.Email))
+	}
+	go sendMembershipMail(adminEmails, fmt.Sprintf("Nautilus cluster: %s requests access to namespace %s", user.Spec.Name, nsName), req, user)
+
+	return nil
+}
+
+// Returns the admin members of the namespace
+func (s *Server) getNamespaceAdmins(nsName string) []nautilusapi.PRPUser {
+	admins := []nautilusapi.PRPUser{}
+	if membersList, err := s.members.NamespaceMembers(nsName).List(metav1.ListOptions{}); err == nil {
+		for _, member := range membersList.Items {
+			if member.Spec.Role != nautilusapi.NamespaceRoleAdmin {
+				continue
+			}
+			if user, err := s.GetUser(member.Spec.UserID); err == nil {
+				admins = append(admins, *user)
+			} else {
+				log.Printf("Error getting admins of namespace %s: %s", nsName, err.Error())
+			}
+		}
+	}
+	return admins
+}
+
+func sendMembershipMail(destination []string, subject string, req *nautilusv1alpha1api.NamespaceMembershipRequest, user *nautilusapi.PRPUser) {
+	r := NewMailRequest(destination, subject)
+
+	err := r.parseTemplate("templates/membershipmail.tmpl", map[string]interface{}{
+		"request":    req,
+		"user":       user,
+		"clusterUrl": viper.GetString("cluster_url"),
+	})
+	if err != nil {
+		log.Printf("Error parsing the email template: %s", err.Error())
+		return
+	}
+	if err := r.sendMail(); err != nil {
+		log.Printf("Failed to send the email to %s : %s\n", r.to, err.Error())
+	} else {
+		log.Printf("Email has been sent to %s\n", r.to)
+	}
+}
+
+// Process the /membership path
+func (s *Server) MembershipHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
+	if err != nil {
+		log.Printf("Error getting the session: %s", err.Error())
+	}
+
+	if session.IsNew || session.Values["userid"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := s.GetUser(session.Values["userid"].(string))
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		reqsList, err := s.membershipRequests.List(metav1.ListOptions{})
+		if err != nil {
+			session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+			session.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		nsAdmin := map[string]bool{}
+		reqs := []MembershipRequestItem{}
+		for _, req := range reqsList.Items {
+			if !req.IsPending() {
+				continue
+			}
+			if _, ok := nsAdmin[req.Spec.Namespace]; !ok {
+				nsAdmin[req.Spec.Namespace] = s.clusters[0].IsNamespaceAdmin(user, req.Spec.Namespace)
+			}
+			if !nsAdmin[req.Spec.Namespace] {
+				continue
+			}
+			reqItem := MembershipRequestItem{Request: req}
+			if requser, err := s.GetUser(req.Spec.UserID); err == nil {
+				reqItem.User = *requser
+			}
+			reqs = append(reqs, reqItem)
+		}
+
+		t, err := template.New("layout.tmpl").ParseFiles("templates/layout.tmpl", "templates/membership.tmpl")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+		} else {
+			err = t.ExecuteTemplate(w, "layout.tmpl", MembershipTemplateVars{Requests: reqs, IndexTemplateVars: s.buildIndexTemplateVars(session, w, r)})
+			if err != nil {
+				w.Write([]byte(err.Error()))
+			}
+		}
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		req, err := s.membershipRequests.Get(r.PostFormValue("request"), metav1.GetOptions{})
+		if err != nil {
+			session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+			session.Save(r, w)
+			http.Redirect(w, r, "/membership", http.StatusSeeOther)
+			return
+		}
+
+		if !req.IsPending() || !s.clusters[0].IsNamespaceAdmin(user, req.Spec.Namespace) {
+			session.AddFlash("Unauthorized")
+			session.Save(r, w)
+			http.Redirect(w, r, "/membership", http.StatusSeeOther)
+			return
+		}
+
+		requser, err := s.GetUser(req.Spec.UserID)
+		if err != nil {
+			session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+			session.Save(r, w)
+			http.Redirect(w, r, "/membership", http.StatusSeeOther)
+			return
+		}
+
+		before := map[string]string{"state": req.Spec.State}
+		after := map[string]string{}
+		switch r.PostFormValue("action") {
+		case "approve":
+			if requser.IsGuest() {
+				session.AddFlash(fmt.Sprintf("User %s has to be validated before joining a namespace", requser.Spec.Email))
+				session.Save(r, w)
+				http.Redirect(w, r, "/membership", http.StatusSeeOther)
+				return
+			}
+
+			role := r.PostFormValue("role")
+			if !isNamespaceRole(role) {
+				session.AddFlash(fmt.Sprintf("Unknown namespace role '%s'", role))
+				session.Save(r, w)
+				http.Redirect(w, r, "/membership", http.StatusSeeOther)
+				return
+			}
+
+			if err := s.addNamespaceMember(req.Spec.Namespace, requser, role); err != nil {
+				session.AddFlash(fmt.Sprintf("Error adding user to namespace: %s", err.Error()))
+				session.Save(r, w)
+				http.Redirect(w, r, "/membership", http.StatusSeeOther)
+				return
+			}
+			s.recordUserNamespace(requser.Spec.UserID, req.Spec.Namespace)
+			req.Spec.State = "approved"
+			after["role"] = role
+		case "deny":
+			req.Spec.State = "denied"
+		default:
+			session.AddFlash(fmt.Sprintf("Unknown action: %s", r.PostFormValue("action")))
+			session.Save(r, w)
+			http.Redirect(w, r, "/membership", http.StatusSeeOther)
+			return
+		}
+
+		req.Spec.ReviewedBy = user.Spec.UserID
+		if _, err := s.membershipRequests.Update(req); err != nil {
+			log.Printf("Error updating the membership request %s: %s", req.Name, err.Error())
+		}
+		after["state"] = req.Spec.State
+		s.audit(r, user, auditMembershipReview, requser.Spec.UserID, req.Spec.Namespace, before, after)
+
+		go sendMembershipMail([]string{fmt.Sprintf("%s <%s>", requser.Spec.Name, requser.Spec.Email)}, fmt.Sprintf("Nautilus cluster: your request to join namespace %s was %s", req.Spec.Namespace, req.Spec.State), req, requser)
+
+		session.AddFlash(fmt.Sprintf("The request of %s to join namespace %s was %s.", requser.Spec.Email, req.Spec.Namespace, req.Spec.State))
+		session.Save(r, w)
+		http.Redirect(w, r, "/membership", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The namespace metadata values are kept in the namespace annotations with the field name after the prefix
+const nsMetaAnnotationPrefix = "meta.optiputer.net/"
+
+// Marks the namespaces which had the metadata copied from the legacy meta config map
+const nsMetaImportedAnnotation = "optiputer.net/meta-imported"
+
+// The legacy config map in the namespace keeping the PI and Grant
+const legacyNsMetaConfigMap = "meta"
+
+// The namespace metadata field types
+const (
+	nsMetaText     = "text"
+	nsMetaTextarea = "textarea"
+	nsMetaEmail    = "email"
+	nsMetaUrl      = "url"
+	nsMetaSelect   = "select"
+)
+
+// The default length limit of the metadata values
+const nsMetaMaxLength = 1024
+
+var nsMetaNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// NsMetaField is a field of the namespace metadata schema
+type NsMetaField struct {
+	Name      string   `mapstructure:"name" json:"name"`            // annotation name after the prefix, lowercase letters, digits and dashes
+	Title     string   `mapstructure:"title" json:"title"`          // shown in the portal and the CSV header
+	Type      string   `mapstructure:"type" json:"type"`            // text, textarea, email, url or select
+	Options   []string `mapstructure:"options" json:"options"`      // the choices of the select fields
+	Required  bool     `mapstructure:"required" json:"required"`    // the value can't be cleared once set
+	MaxLength int      `mapstructure:"max_length" json:"maxLength"` // nsMetaMaxLength if not set
+}
+
+// The schema used when namespace_metadata is not set
+var defaultNsMetaFields = []NsMetaField{
+	{Name: "pi", Title: "PI", Type: nsMetaText},
+	{Name: "grant", Title: "Grant", Type: nsMetaText},
+	{Name: "institution", Title: "Institution", Type: nsMetaText},
+	{Name: "funding-agency", Title: "Funding agency", Type: nsMetaSelect, Options: []string{"NSF", "NIH", "DOE", "DOD", "NASA", "Other"}},
+	{Name: "field-of-science", Title: "Field of science", Type: nsMetaText},
+	{Name: "contact-email", Title: "Contact email", Type: nsMetaEmail},
+	{Name: "description", Title: "Description", Type: nsMetaTextarea},
+	{Name: "url", Title: "Public URL", Type: nsMetaUrl},
+}
+
+// The legacy meta config map keys, by the field name they're imported to
+var legacyNsMetaKeys = map[string]string{"pi": "PI", "grant": "Grant"}
+
+// Returns the namespace metadata schema from namespace_metadata config. Fields with invalid definitions are skipped.
+func nsMetaFields() []NsMetaField {
+	fields := []NsMetaField{}
+	if err := viper.UnmarshalKey("namespace_metadata", &fields); err != nil {
+		log.Printf("Error parsing the namespace metadata schema: %s", err.Error())
+	}
+	if len(fields) == 0 {
+		return defaultNsMetaFields
+	}
+
+	validFields := []NsMetaField{}
+	for _, field := range fields {
+		if field.Type == "" {
+			field.Type = nsMetaText
+		}
+		if field.Title == "" {
+			field.Title = field.Name
+		}
+		switch {
+		case !nsMetaNameRegexp.MatchString(field.Name):
+			log.Printf("Namespace metadata field name %q should be lowercase letters, digits and dashes", field.Name)
+		case field.Type != nsMetaText && field.Type != nsMetaTextarea && field.Type != nsMetaEmail && field.Type != nsMetaUrl && field.Type != nsMetaSelect:
+			log.Printf("Namespace metadata field %s has unknown type %s", field.Name, field.Type)
+		case field.Type == nsMetaSelect && len(field.Options) == 0:
+			log.Printf("Namespace metadata field %s has no options", field.Name)
+		default:
+			validFields = append(validFields, field)
+		}
+	}
+	return validFields
+}
+
+// Returns the schema field with the name, or nil if there's none
+func getNsMetaField(name string) *NsMetaField {
+	for _, field := range nsMetaFields() {
+		if field.Name == name {
+			return &field
+		}
+	}
+	return nil
+}
+
+// Checks the value against the field type and limits
+func (field NsMetaField) validate(value string) error {
+	if value == "" {
+		if field.Required {
+			return fmt.Errorf("%s is required", field.Title)
+		}
+		return nil
+	}
+
+	maxLength := field.MaxLength
+	if maxLength <= 0 {
+		maxLength = nsMetaMaxLength
+	}
+	if len(value) > maxLength {
+		return fmt.Errorf("%s should be at most %d characters long", field.Title, maxLength)
+	}
+
+	switch field.Type {
+	case nsMetaEmail:
+		if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+			return fmt.Errorf("%s should be an email address", field.Title)
+		}
+	case nsMetaUrl:
+		if parsed, err := url.ParseRequestURI(value); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%s should be an http or https URL", field.Title)
+		}
+	case nsMetaSelect:
+		if !containsString(field.Options, value) {
+			return fmt.Errorf("%s should be one of %v", field.Title, field.Options)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the namespace metadata values by the field name
+func nsMetadata(ns *v1.Namespace) map[string]string {
+	metadata := map[string]string{}
+	for _, field := range nsMetaFields() {
+		if value, ok := ns.Annotations[nsMetaAnnotationPrefix+field.Name]; ok {
+			metadata[field.Name] = value
+		}
+	}
+	return metadata
+}
+
+// Validates and sets the namespace metadata field. The empty value removes it.
+func (s *Server) setNsMeta(nsName string, fieldName string, value string) error {
+	field := getNsMetaField(fieldName)
+	if field == nil {
+		return fmt.Errorf("Unknown namespace metadata field %s", fieldName)
+	}
+	if err := field.validate(value); err != nil {
+		return err
+	}
+
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	if value == "" {
+		delete(ns.Annotations, nsMetaAnnotationPrefix+field.Name)
+	} else {
+		ns.Annotations[nsMetaAnnotationPrefix+field.Name] = value
+	}
+	_, err = s.clientset.Core().Namespaces().Update(ns)
+	return err
+}
+
+// Copies the PI and Grant from the legacy meta config maps to the namespace annotations, once per namespace
+func (s *Server) importNsMetadata() error {
+	nsList, err := s.clientset.Core().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		if ns.Annotations[nsMetaImportedAnnotation] != "" || ns.Status.Phase == v1.NamespaceTerminating {
+			continue
+		}
+		if ns.Annotations == nil {
+			ns.Annotations = map[string]string{}
+		}
+
+		if confMap, err := s.clientset.Core().ConfigMaps(ns.Name).Get(legacyNsMetaConfigMap, metav1.GetOptions{}); err == nil {
+			for fieldName, key := range legacyNsMetaKeys {
+				if value := confMap.Data[key]; value != "" && ns.Annotations[nsMetaAnnotationPrefix+fieldName] == "" {
+					ns.Annotations[nsMetaAnnotationPrefix+fieldName] = value
+				}
+			}
+		}
+
+		ns.Annotations[nsMetaImportedAnnotation] = "true"
+		if _, err := s.clientset.Core().Namespaces().Update(ns); err != nil {
+			log.Printf("Error importing the metadata of namespace %s: %s", ns.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Writes the metadata of all namespaces as CSV, with the expiration date
+func (s *Server) writeNsMetaCsv(w http.ResponseWriter) {
+	nsList, err := s.clientset.Core().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	fields := nsMetaFields()
+	header := []string{"Namespace"}
+	for _, field := range fields {
+		header = append(header, field.Title)
+	}
+	header = append(header, "Expires", "Created")
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"namespaces.csv\"")
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(header)
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		metadata := nsMetadata(ns)
+		row := []string{ns.Name}
+		for _, field := range fields {
+			row = append(row, csvCell(metadata[field.Name]))
+		}
+		expires := ""
+		if nsExpiresTime := nsExpires(ns); nsExpiresTime != nil {
+			expires = nsExpiresTime.Format(nsExpiresFormat)
+		}
+		row = append(row, expires, ns.CreationTimestamp.Format(nsExpiresFormat))
+		csvWriter.Write(row)
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		log.Printf("Error writing the namespaces CSV: %s", err.Error())
+	}
+}
+
+// Quotes the values the spreadsheets would run as formulas
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceMetadata(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	for name, value := range map[string]string{"institution": "UCSD", "contact-email": "pi@ucsd.edu", "funding-agency": "NSF", "url": "https://example.com/lab"} {
+		if status, body := env.post(client, "/nsMeta", url.Values{"pk": {"test-ns"}, "name": {name}, "value": {value}}); status != http.StatusOK {
+			t.Errorf("Expected %s to be set, got %d %s", name, status, body)
+		}
+	}
+
+	for name, value := range map[string]string{"contact-email": "not an email", "funding-agency": "ACME", "url": "ftp://example.com", "unknown": "value"} {
+		if status, _ := env.post(client, "/nsMeta", url.Values{"pk": {"test-ns"}, "name": {name}, "value": {value}}); status != http.StatusBadRequest {
+			t.Errorf("Expected %s=%q to be refused, got %d", name, value, status)
+		}
+	}
+
+	ns, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := nsMetadata(ns)
+	if metadata["institution"] != "UCSD" || metadata["contact-email"] != "pi@ucsd.edu" || metadata["funding-agency"] != "NSF" {
+		t.Errorf("Expected the valid values to be kept, got %v", metadata)
+	}
+
+	// Clearing the value removes it
+	env.post(client, "/nsMeta", url.Values{"pk": {"test-ns"}, "name": {"url"}, "value": {""}})
+	if ns, _ = env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); ns.Annotations[nsMetaAnnotationPrefix+"url"] != "" {
+		t.Errorf("Expected the URL to be removed, got %v", ns.Annotations)
+	}
+
+	env.post(client, "/nsMeta", url.Values{"pk": {"test-ns"}, "name": {"grant"}, "value": {"=HYPERLINK(\"https://example.com\")"}})
+
+	_, body := env.get(client, "/nsMeta?format=csv")
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("Expected the CSV export, got %s: %s", body, err.Error())
+	}
+	if len(records) < 2 || records[0][0] != "Namespace" || !containsString(records[0], "Institution") {
+		t.Fatalf("Expected the header and the namespaces, got %v", records)
+	}
+	found := false
+	for _, record := range records[1:] {
+		if record[0] == "test-ns" {
+			found = containsString(record, "UCSD") && containsString(record, "pi@ucsd.edu")
+			if !containsString(record, "'=HYPERLINK(\"https://example.com\")") {
+				t.Errorf("Expected the formula to be quoted in the export, got %v", record)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected the namespace metadata in the export, got %v", records)
+	}
+}
+
+func TestImportNsMetadata(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	if _, err := env.k8s.Core().Namespaces().Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "legacy-ns"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.k8s.Core().ConfigMaps("legacy-ns").Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: legacyNsMetaConfigMap},
+		Data:       map[string]string{"PI": "Jane Doe", "Grant": "NSF 123"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.server.importNsMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := env.k8s.Core().Namespaces().Get("legacy-ns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata := nsMetadata(ns); metadata["pi"] != "Jane Doe" || metadata["grant"] != "NSF 123" {
+		t.Errorf("Expected the PI and Grant to be imported, got %v", ns.Annotations)
+	}
+
+	// Values cleared after the import are not imported again
+	if err := env.server.setNsMeta("legacy-ns", "pi", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.server.importNsMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if ns, _ = env.k8s.Core().Namespaces().Get("legacy-ns", metav1.GetOptions{}); nsMetadata(ns)["pi"] != "" {
+		t.Errorf("Expected the metadata to be imported only once, got %v", ns.Annotations)
+	}
+}
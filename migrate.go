@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	nautilusclientset "github.com/dimm0/k8s_portal/pkg/client/clientset/versioned"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Rewrites the users stored as v1alpha1 in the v1 format.
+// The CRD has no conversion, so the stored objects keep the old field names until they're written through v1.
+// The spec and the status are written separately, since the status subresource ignores the status in spec updates.
+// The users already stored as v1 are skipped, so that restarting the portal doesn't rewrite them.
+func migrateUsers(nautilusClientset nautilusclientset.Interface) error {
+	oldUsers, err := nautilusClientset.OptiputerV1alpha1().PRPUsers().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	users := nautilusClientset.OptiputerV1().PRPUsers()
+	for i := range oldUsers.Items {
+		newUser := nautilusapi.ConvertFromV1alpha1(&oldUsers.Items[i])
+		if newUser.Spec.UserID == "" {
+			// Stored as v1: the camelCase fields are not read as v1alpha1
+			continue
+		}
+
+		user, err := users.Get(newUser.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			newUser.ResourceVersion = ""
+			if _, err := users.Create(newUser); err != nil {
+				log.Printf("Error migrating user %s: %s", newUser.Name, err.Error())
+			}
+			continue
+		} else if err != nil {
+			log.Printf("Error migrating user %s: %s", newUser.Name, err.Error())
+			continue
+		}
+
+		if !apiequality.Semantic.DeepEqual(user.Spec, newUser.Spec) {
+			user.Spec = newUser.Spec
+			if user, err = users.Update(user); err != nil {
+				log.Printf("Error migrating user %s: %s", newUser.Name, err.Error())
+				continue
+			}
+		}
+
+		if apiequality.Semantic.DeepEqual(user.Status, newUser.Status) {
+			continue
+		}
+		user.Status = newUser.Status
+		if _, err = users.UpdateStatus(user); apierrors.IsNotFound(err) || apierrors.IsMethodNotSupported(err) {
+			_, err = users.Update(user)
+		}
+		if err != nil {
+			log.Printf("Error migrating the status of user %s: %s", newUser.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Gives the namespace members created with the global "user" role the editor namespace role
+func migrateMembers(nautilusClientset nautilusclientset.Interface) error {
+	membersList, err := nautilusClientset.OptiputerV1().NamespaceMembers("").List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range membersList.Items {
+		member := &membersList.Items[i]
+		if member.Spec.Role != nautilusapi.RoleUser {
+			continue
+		}
+		member.Spec.Role = nautilusapi.NamespaceRoleEditor
+		if _, err := nautilusClientset.OptiputerV1().NamespaceMembers(member.Namespace).Update(member); err != nil {
+			log.Printf("Error migrating member %s of namespace %s: %s", member.Name, member.Namespace, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	nautilusv1alpha1api "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	nautilusfake "github.com/dimm0/k8s_portal/pkg/client/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMigrateUsers(t *testing.T) {
+	lastLogin := metav1.NewTime(time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC))
+	clientset := nautilusfake.NewSimpleClientset(
+		&nautilusv1alpha1api.PRPUser{
+			ObjectMeta: metav1.ObjectMeta{Name: userObjectName("admin-id")},
+			Spec: nautilusv1alpha1api.PRPUserSpec{
+				UserID: "admin-id",
+				ISS:    "https://issuer",
+				Email:  "admin@example.org",
+				Role:   "Admin",
+			},
+			Status: nautilusv1alpha1api.PRPUserStatus{
+				LastLogin:  &lastLogin,
+				Namespaces: []string{"ns1"},
+			},
+		},
+		&nautilusv1alpha1api.PRPUser{
+			ObjectMeta: metav1.ObjectMeta{Name: userObjectName("other-id")},
+			Spec: nautilusv1alpha1api.PRPUserSpec{
+				UserID: "other-id",
+				ISS:    "https://issuer",
+				Role:   "superuser",
+			},
+		},
+	)
+
+	if err := migrateUsers(clientset); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := clientset.OptiputerV1().PRPUsers().Get(userObjectName("admin-id"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("User was not migrated: %s", err)
+	}
+	if admin.Spec.UserID != "admin-id" || admin.Spec.Email != "admin@example.org" {
+		t.Errorf("Unexpected migrated spec %+v", admin.Spec)
+	}
+	if admin.Spec.Role != nautilusapi.RoleAdmin {
+		t.Errorf("Expected the role to be lowercased, got %q", admin.Spec.Role)
+	}
+	if admin.Status.LastLogin == nil || !admin.Status.LastLogin.Equal(&lastLogin) {
+		t.Errorf("Last login was not migrated: %v", admin.Status.LastLogin)
+	}
+	if !containsString(admin.Status.Namespaces, "ns1") {
+		t.Errorf("Namespaces were not migrated: %v", admin.Status.Namespaces)
+	}
+
+	other, err := clientset.OptiputerV1().PRPUsers().Get(userObjectName("other-id"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("User was not migrated: %s", err)
+	}
+	if other.Spec.Role != nautilusapi.RoleGuest {
+		t.Errorf("Expected an unknown role to become guest, got %q", other.Spec.Role)
+	}
+
+	// Running it again on the already migrated users keeps them
+	clientset.ClearActions()
+	if err := migrateUsers(clientset); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "list" && action.GetVerb() != "get" {
+			t.Errorf("Expected the migrated users not to be written again, got %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	if admin, err = clientset.OptiputerV1().PRPUsers().Get(userObjectName("admin-id"), metav1.GetOptions{}); err != nil || admin.Spec.Role != nautilusapi.RoleAdmin {
+		t.Errorf("Second migration changed the user: %v %v", admin, err)
+	}
+}
+
+func TestMigrateMembers(t *testing.T) {
+	clientset := nautilusfake.NewSimpleClientset(
+		&nautilusapi.NamespaceMember{
+			ObjectMeta: metav1.ObjectMeta{Name: userObjectName("user-id"), Namespace: "ns1"},
+			Spec:       nautilusapi.NamespaceMemberSpec{UserID: "user-id", Role: nautilusapi.RoleUser},
+		},
+		&nautilusapi.NamespaceMember{
+			ObjectMeta: metav1.ObjectMeta{Name: userObjectName("admin-id"), Namespace: "ns1"},
+			Spec:       nautilusapi.NamespaceMemberSpec{UserID: "admin-id", Role: nautilusapi.NamespaceRoleAdmin},
+		},
+	)
+
+	if err := migrateMembers(clientset); err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, role := range map[string]string{"user-id": nautilusapi.NamespaceRoleEditor, "admin-id": nautilusapi.NamespaceRoleAdmin} {
+		member, err := clientset.OptiputerV1().NamespaceMembers("ns1").Get(userObjectName(userID), metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if member.Spec.Role != role {
+			t.Errorf("Expected member %s to have role %s, got %s", userID, role, member.Spec.Role)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	"github.com/spf13/viper"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The namespaces deleted with the grace period are labeled, and deleted after the annotation time
+const (
+	nsPendingDeletionLabel  = "optiputer.net/pending-deletion"
+	nsDeleteAfterAnnotation = "optiputer.net/delete-after"
+)
+
+// The namespaces which can never be deleted from the portal, in addition to protected_namespaces
+var builtinProtectedNamespaces = []string{"default", "kube-*"}
+
+type NsDeleteTemplateVars struct {
+	IndexTemplateVars
+	Namespace   string
+	Preview     NsDeletePreview
+	Grace       string
+	DeleteAfter string
+}
+
+// NsDeletePreview lists what's destroyed with the namespace
+type NsDeletePreview struct {
+	Pods                   []string
+	PersistentVolumeClaims []string
+	Services               []string
+	Jobs                   []string
+}
+
+// Returns true if the namespace matches one of the protected_namespaces patterns (in path.Match format)
+func isProtectedNamespace(nsName string) bool {
+	for _, pattern := range append(builtinProtectedNamespaces, viper.GetStringSlice("protected_namespaces")...) {
+		if matched, err := path.Match(pattern, nsName); err != nil {
+			log.Printf("Error matching the protected namespace pattern %s: %s", pattern, err.Error())
+		} else if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the time the namespace pending deletion is deleted after, or nil if it's not pending deletion
+func nsDeleteAfter(ns *v1.Namespace) *time.Time {
+	if ns.Labels[nsPendingDeletionLabel] == "" {
+		return nil
+	}
+	if deleteAfter, err := time.Parse(time.RFC3339, ns.Annotations[nsDeleteAfterAnnotation]); err == nil {
+		return &deleteAfter
+	}
+	return nil
+}
+
+// Lists the objects in the namespace which are destroyed with it
+func (s *Server) nsDeletePreview(nsName string) (NsDeletePreview, error) {
+	preview := NsDeletePreview{}
+
+	pods, err := s.clientset.Core().Pods(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return preview, err
+	}
+	for _, pod := range pods.Items {
+		preview.Pods = append(preview.Pods, pod.Name)
+	}
+
+	pvcs, err := s.clientset.Core().PersistentVolumeClaims(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return preview, err
+	}
+	for _, pvc := range pvcs.Items {
+		preview.PersistentVolumeClaims = append(preview.PersistentVolumeClaims, pvc.Name)
+	}
+
+	services, err := s.clientset.Core().Services(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return preview, err
+	}
+	for _, service := range services.Items {
+		preview.Services = append(preview.Services, service.Name)
+	}
+
+	jobs, err := s.clientset.BatchV1().Jobs(nsName).List(metav1.ListOptions{})
+	if err != nil {
+		return preview, err
+	}
+	for _, job := range jobs.Items {
+		preview.Jobs = append(preview.Jobs, job.Name)
+	}
+	return preview, nil
+}
+
+// Deletes the namespace as the user. With namespace_deletion_grace set, the namespace is archived and labeled instead,
+// and deleted after the grace period unless restored. Returns the time of the deletion for the soft-deleted namespace.
+func (s *Server) deleteNamespace(userclientset kubernetes.Interface, nsName string, now time.Time) (*time.Time, error) {
+	grace := viper.GetDuration("namespace_deletion_grace")
+	if grace <= 0 {
+		if err := userclientset.Core().Namespaces().Delete(nsName, &metav1.DeleteOptions{}); err != nil {
+			return nil, err
+		}
+		s.forgetNamespace(nsName)
+		return nil, nil
+	}
+
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !nsArchived(ns) {
+		if err := s.archiveNamespace(nsName, now); err != nil {
+			return nil, err
+		}
+		if ns, err = s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	deleteAfter := now.Add(grace)
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	ns.Labels[nsPendingDeletionLabel] = "true"
+	ns.Annotations[nsDeleteAfterAnnotation] = deleteAfter.Format(time.RFC3339)
+	if _, err := s.clientset.Core().Namespaces().Update(ns); err != nil {
+		return nil, err
+	}
+	return &deleteAfter, nil
+}
+
+// Cancels the pending deletion of the namespace. The namespace stays archived until it's renewed.
+func (s *Server) restoreNamespace(nsName string) error {
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if nsDeleteAfter(ns) == nil {
+		return fmt.Errorf("Namespace %s is not pending deletion", nsName)
+	}
+	delete(ns.Labels, nsPendingDeletionLabel)
+	delete(ns.Annotations, nsDeleteAfterAnnotation)
+	_, err = s.clientset.Core().Namespaces().Update(ns)
+	return err
+}
+
+// Deletes the namespaces which are pending deletion past their grace period
+func (s *Server) deletePendingNamespaces(now time.Time) {
+	nsList, err := s.clientset.Core().Namespaces().List(metav1.ListOptions{LabelSelector: nsPendingDeletionLabel})
+	if err != nil {
+		log.Printf("Error getting the namespaces pending deletion: %s", err.Error())
+		return
+	}
+
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		deleteAfter := nsDeleteAfter(ns)
+		if deleteAfter == nil || now.Before(*deleteAfter) || ns.Status.Phase == v1.NamespaceTerminating {
+			continue
+		}
+		if isProtectedNamespace(ns.Name) {
+			log.Printf("Not deleting protected namespace %s pending deletion", ns.Name)
+			continue
+		}
+		if err := s.clientset.Core().Namespaces().Delete(ns.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Printf("Error deleting namespace %s: %s", ns.Name, err.Error())
+			continue
+		}
+		s.forgetNamespace(ns.Name)
+		s.audit(nil, nil, auditNamespaceDelete, ns.Name, ns.Name, map[string]string{"deleteAfter": ns.Annotations[nsDeleteAfterAnnotation]}, nil)
+		log.Printf("Deleted namespace %s after the grace period", ns.Name)
+	}
+}
+
+// Process the /nsDelete path - shows what's destroyed with the namespace, and deletes or restores it
+func (s *Server) NsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
+	if err != nil {
+		log.Printf("Error getting the session: %s", err.Error())
+	}
+
+	if session.IsNew || session.Values["userid"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := s.GetUser(session.Values["userid"].(string))
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if user.Spec.Role != nautilusapi.RoleAdmin {
+		session.AddFlash("Only admins can manage namespaces")
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	nsName := r.FormValue("namespace")
+	ns, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{})
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Error getting namespace %s: %s", nsName, err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	if isProtectedNamespace(nsName) {
+		session.AddFlash(fmt.Sprintf("Can't delete protected namespace %s", nsName))
+		session.Save(r, w)
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	if !s.clusters[0].IsNamespaceAdmin(user, nsName) {
+		session.AddFlash(fmt.Sprintf("You're not an admin of namespace %s", nsName))
+		session.Save(r, w)
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		preview, err := s.nsDeletePreview(nsName)
+		if err != nil {
+			session.AddFlash(fmt.Sprintf("Error getting the namespace objects: %s", err.Error()))
+			session.Save(r, w)
+		}
+
+		nsVars := NsDeleteTemplateVars{IndexTemplateVars: s.buildIndexTemplateVars(session, w, r), Namespace: nsName, Preview: preview}
+		if grace := viper.GetDuration("namespace_deletion_grace"); grace > 0 {
+			nsVars.Grace = grace.String()
+		}
+		if deleteAfter := nsDeleteAfter(ns); deleteAfter != nil {
+			nsVars.DeleteAfter = deleteAfter.Format(time.RFC1123)
+		}
+
+		t, err := template.New("layout.tmpl").ParseFiles("templates/layout.tmpl", "templates/nsdelete.tmpl")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+		} else {
+			err = t.ExecuteTemplate(w, "layout.tmpl", nsVars)
+			if err != nil {
+				w.Write([]byte(err.Error()))
+			}
+		}
+	case "POST":
+		if r.PostFormValue("action") == "restore" {
+			before := s.nsAuditState(nsName)
+			if err := s.restoreNamespace(nsName); err != nil {
+				session.AddFlash(fmt.Sprintf("Error restoring namespace %s: %s", nsName, err.Error()))
+			} else {
+				s.audit(r, user, auditNamespaceRestore, nsName, nsName, before, s.nsAuditState(nsName))
+				session.AddFlash(fmt.Sprintf("Restored namespace %s. Renew it to start the archived workloads.", nsName))
+			}
+			session.Save(r, w)
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		if r.PostFormValue("confirm") != nsName {
+			session.AddFlash("Type the namespace name to confirm the deletion")
+			session.Save(r, w)
+			http.Redirect(w, r, "/nsDelete?"+url.Values{"namespace": {nsName}}.Encode(), http.StatusSeeOther)
+			return
+		}
+
+		userclientset, err := s.clusters[0].GetUserClientset(user)
+		if err != nil {
+			session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+			session.Save(r, w)
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		before := s.nsAuditState(nsName)
+		if deleteAfter, err := s.deleteNamespace(userclientset, nsName, time.Now()); err != nil {
+			session.AddFlash(fmt.Sprintf("Error deleting the namespace: %s", err.Error()))
+		} else if deleteAfter != nil {
+			s.audit(r, user, auditNamespaceSoftDelete, nsName, nsName, before, s.nsAuditState(nsName))
+			session.AddFlash(fmt.Sprintf("The namespace %s is archived and will be deleted after %s. It can be restored until then.", nsName, deleteAfter.Format(time.RFC1123)))
+		} else {
+			s.audit(r, user, auditNamespaceDelete, nsName, nsName, before, nil)
+			session.AddFlash(fmt.Sprintf("The namespace %s is being deleted. Please update the page or use kubectl to see the result.", nsName))
+		}
+		session.Save(r, w)
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceDeleteConfirmation(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	if _, err := env.k8s.Core().PersistentVolumeClaims("test-ns").Create(&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-volume"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := env.get(client, "/nsDelete?namespace=test-ns"); !strings.Contains(body, "data-volume") {
+		t.Errorf("Expected the volume claim in the deletion preview, got %s", body)
+	}
+
+	for _, values := range []url.Values{
+		{"namespace": {"test-ns"}, "confirm": {"test-ns"}, "csrf_token": {""}},
+		{"namespace": {"test-ns"}, "confirm": {"test-ns"}, "csrf_token": {"forged"}},
+		{"namespace": {"test-ns"}, "confirm": {"other-ns"}},
+	} {
+		env.post(client, "/nsDelete", values)
+		if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); err != nil {
+			t.Errorf("Namespace was deleted by %v: %v", values, err)
+		}
+	}
+
+	viper.Set("protected_namespaces", []string{"test-*"})
+	defer viper.Set("protected_namespaces", nil)
+	env.post(client, "/nsDelete", url.Values{"namespace": {"test-ns"}, "confirm": {"test-ns"}})
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); err != nil {
+		t.Errorf("Protected namespace was deleted: %v", err)
+	}
+}
+
+func TestNamespaceSoftDelete(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	viper.Set("namespace_deletion_grace", "72h")
+	defer viper.Set("namespace_deletion_grace", nil)
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	env.post(client, "/nsDelete", url.Values{"namespace": {"test-ns"}, "confirm": {"test-ns"}})
+	ns, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the namespace to be kept for the grace period: %s", err.Error())
+	}
+	deleteAfter := nsDeleteAfter(ns)
+	if deleteAfter == nil || !nsArchived(ns) {
+		t.Fatalf("Expected the namespace to be archived and pending deletion, got %v %v", ns.Labels, ns.Annotations)
+	}
+
+	env.server.deletePendingNamespaces(deleteAfter.Add(-time.Minute))
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); err != nil {
+		t.Errorf("Namespace was deleted before the grace period: %v", err)
+	}
+
+	env.post(client, "/nsDelete", url.Values{"namespace": {"test-ns"}, "action": {"restore"}})
+	if ns, _ = env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); nsDeleteAfter(ns) != nil {
+		t.Errorf("Expected the namespace to be restored, got %v", ns.Labels)
+	}
+	env.server.deletePendingNamespaces(deleteAfter.Add(time.Minute))
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); err != nil {
+		t.Errorf("Restored namespace was deleted: %v", err)
+	}
+
+	env.post(client, "/nsDelete", url.Values{"namespace": {"test-ns"}, "confirm": {"test-ns"}})
+	env.server.deletePendingNamespaces(time.Now().Add(73 * time.Hour))
+	if _, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the namespace to be deleted after the grace period: %v", err)
+	}
+	if user := env.getUser(testAdmin); containsString(user.Status.Namespaces, "test-ns") {
+		t.Errorf("Deleted namespace was kept in the user status")
+	}
+}
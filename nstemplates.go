@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Records the template the namespace was created with
+const nsTemplateAnnotation = "optiputer.net/template"
+
+// The template used for the namespaces created without choosing one
+const defaultNsTemplate = "default"
+
+// Returns the template chosen for the new namespace. Without a choice the default template is used if it's defined,
+// and nil is returned if it's not.
+func (s *Server) getNamespaceTemplate(name string) (*nautilusapi.NamespaceTemplate, error) {
+	if name != "" {
+		return s.namespaceTemplates.Get(name, metav1.GetOptions{})
+	}
+	tmpl, err := s.namespaceTemplates.Get(defaultNsTemplate, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return tmpl, err
+}
+
+// Returns the namespace object with the labels and annotations of the template
+func templateNamespace(nsName string, tmpl *nautilusapi.NamespaceTemplate) *v1.Namespace {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        nsName,
+		Labels:      map[string]string{},
+		Annotations: map[string]string{},
+	}}
+	if tmpl != nil {
+		for key, value := range tmpl.Spec.Labels {
+			ns.Labels[key] = value
+		}
+		for key, value := range tmpl.Spec.Annotations {
+			ns.Annotations[key] = value
+		}
+		ns.Annotations[nsTemplateAnnotation] = tmpl.Name
+	}
+	ns.Annotations[membersImportedAnnotation] = "true"
+	ns.Annotations[nsMetaImportedAnnotation] = "true"
+	return ns
+}
+
+// Returns the object metadata for the copy in the namespace
+func templateObjectMeta(meta metav1.ObjectMeta, nsName string, defaultName string) metav1.ObjectMeta {
+	newMeta := metav1.ObjectMeta{
+		Name:        meta.Name,
+		Namespace:   nsName,
+		Labels:      meta.Labels,
+		Annotations: meta.Annotations,
+	}
+	if newMeta.Name == "" {
+		newMeta.Name = defaultName
+	}
+	return newMeta
+}
+
+// Creates the objects of the template in the namespace, returning the errors of the ones that failed.
+// The limit ranges and quotas without a name get the ones the portal manages, so that they can be edited from the quota page.
+func (s *Server) applyNamespaceTemplate(nsName string, tmpl *nautilusapi.NamespaceTemplate) []error {
+	errs := []error{}
+	addErr := func(kind string, name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error creating %s %s from template %s: %s", kind, name, tmpl.Name, err.Error()))
+		}
+	}
+
+	for _, item := range tmpl.Spec.LimitRanges {
+		obj := item.DeepCopy()
+		obj.ObjectMeta = templateObjectMeta(item.ObjectMeta, nsName, nsLimitsName(nsName))
+		_, err := s.clientset.Core().LimitRanges(nsName).Create(obj)
+		addErr("limit range", obj.Name, err)
+	}
+
+	for _, item := range tmpl.Spec.ResourceQuotas {
+		obj := item.DeepCopy()
+		obj.ObjectMeta = templateObjectMeta(item.ObjectMeta, nsName, nsQuotaName)
+		obj.Status = v1.ResourceQuotaStatus{}
+		_, err := s.clientset.Core().ResourceQuotas(nsName).Create(obj)
+		addErr("resource quota", obj.Name, err)
+	}
+
+	for _, item := range tmpl.Spec.NetworkPolicies {
+		obj := item.DeepCopy()
+		obj.ObjectMeta = templateObjectMeta(item.ObjectMeta, nsName, "")
+		_, err := s.clientset.NetworkingV1().NetworkPolicies(nsName).Create(obj)
+		addErr("network policy", obj.Name, err)
+	}
+
+	for _, item := range tmpl.Spec.ConfigMaps {
+		obj := item.DeepCopy()
+		obj.ObjectMeta = templateObjectMeta(item.ObjectMeta, nsName, "")
+		_, err := s.clientset.Core().ConfigMaps(nsName).Create(obj)
+		addErr("config map", obj.Name, err)
+	}
+
+	for _, item := range tmpl.Spec.RoleBindings {
+		obj := item.DeepCopy()
+		obj.ObjectMeta = templateObjectMeta(item.ObjectMeta, nsName, "")
+		// The portal bindings follow the namespace members, and would be reverted
+		if isNsRoleBinding(obj.Name) {
+			addErr("role binding", obj.Name, fmt.Errorf("the role binding is managed by the portal"))
+			continue
+		}
+		for i := range obj.Subjects {
+			if obj.Subjects[i].Kind == "ServiceAccount" && obj.Subjects[i].Namespace == "" {
+				obj.Subjects[i].Namespace = nsName
+			}
+		}
+		_, err := s.clientset.Rbac().RoleBindings(nsName).Create(obj)
+		addErr("role binding", obj.Name, err)
+	}
+
+	return errs
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceTemplate(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	if _, err := env.nautilus.OptiputerV1().NamespaceTemplates().Create(&nautilusapi.NamespaceTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "gpu-project"},
+		Spec: nautilusapi.NamespaceTemplateSpec{
+			Labels:      map[string]string{"project": "gpu"},
+			Annotations: map[string]string{"owner": "lab"},
+			LimitRanges: []v1.LimitRange{{
+				Spec: v1.LimitRangeSpec{Limits: []v1.LimitRangeItem{{
+					Type:    v1.LimitTypeContainer,
+					Default: v1.ResourceList{v1.ResourceMemory: resource.MustParse("8Gi")},
+				}}},
+			}},
+			ResourceQuotas: []v1.ResourceQuota{{
+				Spec: v1.ResourceQuotaSpec{Hard: v1.ResourceList{v1.ResourcePods: resource.MustParse("20")}},
+			}},
+			NetworkPolicies: []networkingv1.NetworkPolicy{{
+				ObjectMeta: metav1.ObjectMeta{Name: "deny-all"},
+			}},
+			ConfigMaps: []v1.ConfigMap{{
+				ObjectMeta: metav1.ObjectMeta{Name: "settings"},
+				Data:       map[string]string{"key": "value"},
+			}},
+			RoleBindings: []rbacv1.RoleBinding{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "monitoring"},
+					RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "view"},
+					Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "prometheus"}},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "nautilus-admin"},
+					RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "cluster-admin"},
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}, "template": {"gpu-project"}})
+
+	ns, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Labels["project"] != "gpu" || ns.Annotations["owner"] != "lab" || ns.Annotations[nsTemplateAnnotation] != "gpu-project" {
+		t.Errorf("Expected the template labels and annotations on the namespace, got %v %v", ns.Labels, ns.Annotations)
+	}
+
+	limits, err := env.server.getNsLimits("test-ns")
+	if err != nil || limits == nil {
+		t.Fatalf("Expected the template limit range: %v", err)
+	}
+	if mem := limits.Default[v1.ResourceMemory]; mem.Cmp(resource.MustParse("8Gi")) != 0 {
+		t.Errorf("Expected the template default memory limit instead of the built-in one, got %s", mem.String())
+	}
+	if quota, err := env.server.getNsQuota("test-ns"); err != nil || quota == nil {
+		t.Errorf("Expected the template quota: %v", err)
+	}
+	if _, err := env.k8s.NetworkingV1().NetworkPolicies("test-ns").Get("deny-all", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the template network policy: %v", err)
+	}
+	if cm, err := env.k8s.Core().ConfigMaps("test-ns").Get("settings", metav1.GetOptions{}); err != nil || cm.Data["key"] != "value" {
+		t.Errorf("Expected the template config map: %v", err)
+	}
+	rb, err := env.k8s.Rbac().RoleBindings("test-ns").Get("monitoring", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.Subjects[0].Namespace != "test-ns" {
+		t.Errorf("Expected the service account subject in the new namespace, got %v", rb.Subjects[0])
+	}
+
+	// The portal bindings can't be replaced by the template
+	if subjects := env.bindingSubjects("test-ns", "nautilus-admin"); !containsString(subjects, "User:"+testAdmin.Subject) {
+		t.Errorf("Expected the creator in the nautilus-admin role binding, got %v", subjects)
+	}
+	if rb, err := env.k8s.Rbac().RoleBindings("test-ns").Get("nautilus-admin", metav1.GetOptions{}); err == nil && rb.RoleRef.Name != "admin" {
+		t.Errorf("Template replaced the nautilus-admin role binding with %v", rb.RoleRef)
+	}
+}
+
+func TestDefaultNamespaceTemplate(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+
+	// Without templates the namespace gets the built-in limits
+	env.post(client, "/profile", url.Values{"mkns": {"plain-ns"}})
+	if limits, err := env.server.getNsLimits("plain-ns"); err != nil || limits == nil {
+		t.Errorf("Expected the built-in limit range: %v", err)
+	}
+
+	if _, err := env.nautilus.OptiputerV1().NamespaceTemplates().Create(&nautilusapi.NamespaceTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultNsTemplate},
+		Spec:       nautilusapi.NamespaceTemplateSpec{Labels: map[string]string{"standard": "true"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	if ns, err := env.k8s.Core().Namespaces().Get("test-ns", metav1.GetOptions{}); err != nil || ns.Labels["standard"] != "true" {
+		t.Errorf("Expected the default template to be used: %v %v", ns, err)
+	}
+}
@@ -0,0 +1,39 @@
+package v1
+
+import (
+	"strings"
+
+	"github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Converts the PRPUser stored as v1alpha1, which used the Go field names as json keys.
+// Roles not allowed in v1 are turned into guest.
+func ConvertFromV1alpha1(in *v1alpha1.PRPUser) *PRPUser {
+	out := &PRPUser{
+		TypeMeta:   metav1.TypeMeta{APIVersion: SchemeGroupVersion.String(), Kind: "PRPUser"},
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+		Spec: PRPUserSpec{
+			UserID: in.Spec.UserID,
+			ISS:    in.Spec.ISS,
+			Email:  in.Spec.Email,
+			Name:   in.Spec.Name,
+			IDP:    in.Spec.IDP,
+			Role:   strings.ToLower(in.Spec.Role),
+		},
+		Status: PRPUserStatus{
+			FirstLogin:         in.Status.FirstLogin.DeepCopy(),
+			LastLogin:          in.Status.LastLogin.DeepCopy(),
+			LastConfigDownload: in.Status.LastConfigDownload.DeepCopy(),
+			LastIDP:            in.Status.LastIDP,
+			Namespaces:         append([]string(nil), in.Status.Namespaces...),
+		},
+	}
+
+	switch out.Spec.Role {
+	case RoleGuest, RoleUser, RoleAdmin:
+	default:
+		out.Spec.Role = RoleGuest
+	}
+	return out
+}
@@ -0,0 +1,233 @@
+package v1
+
+import (
+	"reflect"
+
+	"github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextcs "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	CRDPlural   string = "prpusers"
+	CRDGroup    string = "optiputer.net"
+	CRDVersion  string = "v1"
+	FullCRDName string = CRDPlural + "." + CRDGroup
+
+	MemberCRDPlural   string = "namespacemembers"
+	FullMemberCRDName string = MemberCRDPlural + "." + CRDGroup
+
+	TemplateCRDPlural   string = "namespacetemplates"
+	FullTemplateCRDName string = TemplateCRDPlural + "." + CRDGroup
+)
+
+// Create the PRPUser CRD serving v1 and the old v1alpha1 version, and the NamespaceMember and NamespaceTemplate CRDs,
+// or update the existing ones
+func CreateCRD(clientset apiextcs.Interface) error {
+	if err := createOrUpdateCRD(clientset, FullCRDName, crdSpec()); err != nil {
+		return err
+	}
+	if err := createOrUpdateCRD(clientset, FullMemberCRDName, memberCRDSpec()); err != nil {
+		return err
+	}
+	return createOrUpdateCRD(clientset, FullTemplateCRDName, templateCRDSpec())
+}
+
+func createOrUpdateCRD(clientset apiextcs.Interface, name string, spec apiextv1beta1.CustomResourceDefinitionSpec) error {
+	_, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Create(&apiextv1beta1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       spec,
+	})
+	if err == nil || !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(existing.Spec.Versions, spec.Versions) &&
+		reflect.DeepEqual(existing.Spec.Validation, spec.Validation) &&
+		reflect.DeepEqual(existing.Spec.Subresources, spec.Subresources) &&
+		reflect.DeepEqual(existing.Spec.AdditionalPrinterColumns, spec.AdditionalPrinterColumns) {
+		return nil
+	}
+	existing.Spec.Version = spec.Version
+	existing.Spec.Versions = spec.Versions
+	existing.Spec.Validation = spec.Validation
+	existing.Spec.Subresources = spec.Subresources
+	existing.Spec.AdditionalPrinterColumns = spec.AdditionalPrinterColumns
+	_, err = clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Update(existing)
+	return err
+}
+
+// The v1 version is stored. The objects stored as v1alpha1 are served as is, and are converted by the portal on startup.
+func crdSpec() apiextv1beta1.CustomResourceDefinitionSpec {
+	return apiextv1beta1.CustomResourceDefinitionSpec{
+		Group:   CRDGroup,
+		Version: CRDVersion,
+		Versions: []apiextv1beta1.CustomResourceDefinitionVersion{
+			{Name: CRDVersion, Served: true, Storage: true},
+			{Name: v1alpha1.CRDVersion, Served: true, Storage: false},
+		},
+		Scope: apiextv1beta1.ClusterScoped,
+		Names: apiextv1beta1.CustomResourceDefinitionNames{
+			Plural:   CRDPlural,
+			Singular: "prpuser",
+			Kind:     reflect.TypeOf(PRPUser{}).Name(),
+			ListKind: reflect.TypeOf(PRPUserList{}).Name(),
+		},
+		Subresources: &apiextv1beta1.CustomResourceSubresources{Status: &apiextv1beta1.CustomResourceSubresourceStatus{}},
+		Validation:   &apiextv1beta1.CustomResourceValidation{OpenAPIV3Schema: validationSchema()},
+		AdditionalPrinterColumns: []apiextv1beta1.CustomResourceColumnDefinition{
+			{Name: "Email", Type: "string", JSONPath: ".spec.email"},
+			{Name: "Role", Type: "string", JSONPath: ".spec.role"},
+			{Name: "IDP", Type: "string", JSONPath: ".spec.idp"},
+			{Name: "Last login", Type: "date", JSONPath: ".status.lastLogin", Priority: 1},
+			{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+		},
+	}
+}
+
+// The namespace members only have the v1 version
+func memberCRDSpec() apiextv1beta1.CustomResourceDefinitionSpec {
+	return apiextv1beta1.CustomResourceDefinitionSpec{
+		Group:   CRDGroup,
+		Version: CRDVersion,
+		Versions: []apiextv1beta1.CustomResourceDefinitionVersion{
+			{Name: CRDVersion, Served: true, Storage: true},
+		},
+		Scope: apiextv1beta1.NamespaceScoped,
+		Names: apiextv1beta1.CustomResourceDefinitionNames{
+			Plural:   MemberCRDPlural,
+			Singular: "namespacemember",
+			Kind:     reflect.TypeOf(NamespaceMember{}).Name(),
+			ListKind: reflect.TypeOf(NamespaceMemberList{}).Name(),
+		},
+		Validation: &apiextv1beta1.CustomResourceValidation{OpenAPIV3Schema: &apiextv1beta1.JSONSchemaProps{
+			Type:     "object",
+			Required: []string{"spec"},
+			Properties: map[string]apiextv1beta1.JSONSchemaProps{
+				"spec": {
+					Type:     "object",
+					Required: []string{"userID", "role"},
+					Properties: map[string]apiextv1beta1.JSONSchemaProps{
+						"userID": nonEmptyString(),
+						"role":   enumSchema(NamespaceRoleViewer, NamespaceRoleEditor, NamespaceRoleAdmin),
+					},
+				},
+			},
+		}},
+		AdditionalPrinterColumns: []apiextv1beta1.CustomResourceColumnDefinition{
+			{Name: "User", Type: "string", JSONPath: ".spec.userID"},
+			{Name: "Role", Type: "string", JSONPath: ".spec.role"},
+			{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+		},
+	}
+}
+
+// The namespace templates are cluster-wide and only have the v1 version.
+// The objects in the templates are validated when they're created in the namespaces.
+func templateCRDSpec() apiextv1beta1.CustomResourceDefinitionSpec {
+	str := apiextv1beta1.JSONSchemaProps{Type: "string"}
+	stringMap := apiextv1beta1.JSONSchemaProps{
+		Type:                 "object",
+		AdditionalProperties: &apiextv1beta1.JSONSchemaPropsOrBool{Allows: true, Schema: &str},
+	}
+	objects := apiextv1beta1.JSONSchemaProps{
+		Type:  "array",
+		Items: &apiextv1beta1.JSONSchemaPropsOrArray{Schema: &apiextv1beta1.JSONSchemaProps{Type: "object"}},
+	}
+
+	return apiextv1beta1.CustomResourceDefinitionSpec{
+		Group:   CRDGroup,
+		Version: CRDVersion,
+		Versions: []apiextv1beta1.CustomResourceDefinitionVersion{
+			{Name: CRDVersion, Served: true, Storage: true},
+		},
+		Scope: apiextv1beta1.ClusterScoped,
+		Names: apiextv1beta1.CustomResourceDefinitionNames{
+			Plural:   TemplateCRDPlural,
+			Singular: "namespacetemplate",
+			Kind:     reflect.TypeOf(NamespaceTemplate{}).Name(),
+			ListKind: reflect.TypeOf(NamespaceTemplateList{}).Name(),
+		},
+		Validation: &apiextv1beta1.CustomResourceValidation{OpenAPIV3Schema: &apiextv1beta1.JSONSchemaProps{
+			Type:     "object",
+			Required: []string{"spec"},
+			Properties: map[string]apiextv1beta1.JSONSchemaProps{
+				"spec": {
+					Type: "object",
+					Properties: map[string]apiextv1beta1.JSONSchemaProps{
+						"description":     str,
+						"labels":          stringMap,
+						"annotations":     stringMap,
+						"limitRanges":     objects,
+						"resourceQuotas":  objects,
+						"networkPolicies": objects,
+						"configMaps":      objects,
+						"roleBindings":    objects,
+					},
+				},
+			},
+		}},
+		AdditionalPrinterColumns: []apiextv1beta1.CustomResourceColumnDefinition{
+			{Name: "Description", Type: "string", JSONPath: ".spec.description"},
+			{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+		},
+	}
+}
+
+// Returns the string schema allowing only the values
+func enumSchema(values ...string) apiextv1beta1.JSONSchemaProps {
+	schema := apiextv1beta1.JSONSchemaProps{Type: "string"}
+	for _, value := range values {
+		schema.Enum = append(schema.Enum, apiextv1beta1.JSON{Raw: []byte(`"` + value + `"`)})
+	}
+	return schema
+}
+
+func nonEmptyString() apiextv1beta1.JSONSchemaProps {
+	minLength := int64(1)
+	return apiextv1beta1.JSONSchemaProps{Type: "string", MinLength: &minLength}
+}
+
+func validationSchema() *apiextv1beta1.JSONSchemaProps {
+	str := apiextv1beta1.JSONSchemaProps{Type: "string"}
+	nonEmptyStr := nonEmptyString()
+	dateTime := apiextv1beta1.JSONSchemaProps{Type: "string", Format: "date-time"}
+
+	return &apiextv1beta1.JSONSchemaProps{
+		Type:     "object",
+		Required: []string{"spec"},
+		Properties: map[string]apiextv1beta1.JSONSchemaProps{
+			"spec": {
+				Type:     "object",
+				Required: []string{"userID", "iss", "role"},
+				Properties: map[string]apiextv1beta1.JSONSchemaProps{
+					"userID": nonEmptyStr,
+					"iss":    nonEmptyStr,
+					"email":  str,
+					"name":   str,
+					"idp":    str,
+					"role":   enumSchema(RoleGuest, RoleUser, RoleAdmin),
+				},
+			},
+			"status": {
+				Type: "object",
+				Properties: map[string]apiextv1beta1.JSONSchemaProps{
+					"firstLogin":         dateTime,
+					"lastLogin":          dateTime,
+					"lastConfigDownload": dateTime,
+					"lastIDP":            str,
+					"namespaces": {
+						Type:  "array",
+						Items: &apiextv1beta1.JSONSchemaPropsOrArray{Schema: &str},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,5 @@
+// +k8s:deepcopy-gen=package,register
+
+// Package v1 is the v1 version of the API.
+// +groupName=optiputer.net
+package v1
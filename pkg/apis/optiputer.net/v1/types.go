@@ -0,0 +1,138 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// The user roles allowed by the CRD validation schema
+const (
+	RoleGuest = "guest"
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// The namespace roles allowed by the NamespaceMember validation schema
+const (
+	NamespaceRoleViewer = "viewer"
+	NamespaceRoleEditor = "editor"
+	NamespaceRoleAdmin  = "admin"
+)
+
+// UserFinalizer keeps the deleted PRPUser until the portal removes it from the role bindings
+const UserFinalizer = "optiputer.net/rbac-cleanup"
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PRPUser is a user of the portal
+type PRPUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              PRPUserSpec   `json:"spec"`
+	Status            PRPUserStatus `json:"status,omitempty"`
+}
+
+type PRPUserSpec struct {
+	UserID string `json:"userID"`
+	ISS    string `json:"iss"`
+	Email  string `json:"email,omitempty"`
+	Name   string `json:"name,omitempty"`
+	IDP    string `json:"idp,omitempty"`
+	Role   string `json:"role"` // guest, user, admin
+}
+
+// PRPUserStatus is the user activity in the portal
+type PRPUserStatus struct {
+	FirstLogin         *metav1.Time `json:"firstLogin,omitempty"`
+	LastLogin          *metav1.Time `json:"lastLogin,omitempty"`
+	LastConfigDownload *metav1.Time `json:"lastConfigDownload,omitempty"`
+	LastIDP            string       `json:"lastIDP,omitempty"`
+	Namespaces         []string     `json:"namespaces,omitempty"` // namespaces the user is bound to in the primary cluster
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PRPUserList is a list of PRP users
+type PRPUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PRPUser `json:"items"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NamespaceMember is the membership of a user in the namespace it's created in.
+// The portal keeps the namespace role bindings in sync with the members.
+type NamespaceMember struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              NamespaceMemberSpec `json:"spec"`
+}
+
+type NamespaceMemberSpec struct {
+	UserID string `json:"userID"`
+	Role   string `json:"role"` // viewer, editor, admin
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NamespaceMemberList is a list of namespace members
+type NamespaceMemberList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespaceMember `json:"items"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NamespaceTemplate describes the standard policies of the namespaces created with it
+type NamespaceTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              NamespaceTemplateSpec `json:"spec"`
+}
+
+// The objects are created in the new namespace with the namespace of their metadata replaced
+type NamespaceTemplateSpec struct {
+	Description     string                       `json:"description,omitempty"`
+	Labels          map[string]string            `json:"labels,omitempty"`
+	Annotations     map[string]string            `json:"annotations,omitempty"`
+	LimitRanges     []corev1.LimitRange          `json:"limitRanges,omitempty"`
+	ResourceQuotas  []corev1.ResourceQuota       `json:"resourceQuotas,omitempty"`
+	NetworkPolicies []networkingv1.NetworkPolicy `json:"networkPolicies,omitempty"`
+	ConfigMaps      []corev1.ConfigMap           `json:"configMaps,omitempty"`
+	RoleBindings    []rbacv1.RoleBinding         `json:"roleBindings,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NamespaceTemplateList is a list of namespace templates
+type NamespaceTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespaceTemplate `json:"items"`
+}
+
+// Returns the clientset impersonating the user in the cluster with the given config
+func (user PRPUser) GetUserClientset(k8sconfig *rest.Config) (*kubernetes.Clientset, error) {
+	userk8sconfig := *k8sconfig
+
+	userk8sconfig.Impersonate = rest.ImpersonationConfig{
+		UserName: user.Spec.UserID,
+	}
+
+	return kubernetes.NewForConfig(&userk8sconfig)
+}
+
+func (user PRPUser) IsGuest() bool {
+	return user.Spec.Role == RoleGuest
+}
@@ -7,118 +7,53 @@ import (
 	apiextcs "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	CRDPlural   string = "prpusers"
-	CRDGroup    string = "optiputer.net"
-	CRDVersion  string = "v1alpha1"
-	FullCRDName string = CRDPlural + "." + CRDGroup
+	CRDPlural  string = "prpusers"
+	CRDGroup   string = "optiputer.net"
+	CRDVersion string = "v1alpha1"
+
+	MembershipRequestCRDPlural   string = "namespacemembershiprequests"
+	FullMembershipRequestCRDName string = MembershipRequestCRDPlural + "." + CRDGroup
 )
 
-// Create the CRD resource, ignore error if it already exists
+// Create the CRD resources, ignore error if those already exist.
+// The PRPUser CRD is created by the v1 package, serving both versions.
 func CreateCRD(clientset apiextcs.Interface) error {
+	return createCRD(clientset, FullMembershipRequestCRDName, MembershipRequestCRDPlural, reflect.TypeOf(NamespaceMembershipRequest{}).Name(), nil)
+}
+
+func createCRD(clientset apiextcs.Interface, name string, plural string, kind string, subresources *apiextv1beta1.CustomResourceSubresources) error {
 	crd := &apiextv1beta1.CustomResourceDefinition{
-		ObjectMeta: meta_v1.ObjectMeta{Name: FullCRDName},
+		ObjectMeta: meta_v1.ObjectMeta{Name: name},
 		Spec: apiextv1beta1.CustomResourceDefinitionSpec{
 			Group:   CRDGroup,
 			Version: CRDVersion,
 			Scope:   apiextv1beta1.ClusterScoped,
 			Names: apiextv1beta1.CustomResourceDefinitionNames{
-				Plural: CRDPlural,
-				Kind:   reflect.TypeOf(PRPUser{}).Name(),
+				Plural: plural,
+				Kind:   kind,
 			},
+			Subresources: subresources,
 		},
 	}
 
 	_, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Create(crd)
 	if err != nil && apierrors.IsAlreadyExists(err) {
-		return nil
+		// Enable the subresources added after the CRD was created
+		existing, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if reflect.DeepEqual(existing.Spec.Subresources, subresources) {
+			return nil
+		}
+		existing.Spec.Subresources = subresources
+		_, err = clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Update(existing)
+		return err
 	}
 	return err
 
 	// Note the original apiextensions example adds logic to wait for creation and exception handling
 }
-
-func NewClient(cfg *rest.Config) (*rest.RESTClient, *runtime.Scheme, error) {
-	scheme := runtime.NewScheme()
-	SchemeBuilder := runtime.NewSchemeBuilder(addKnownTypes)
-	if err := SchemeBuilder.AddToScheme(scheme); err != nil {
-		return nil, nil, err
-	}
-	config := *cfg
-	config.GroupVersion = &SchemeGroupVersion
-	config.APIPath = "/apis"
-	config.ContentType = runtime.ContentTypeJSON
-	config.NegotiatedSerializer = serializer.DirectCodecFactory{
-		CodecFactory: serializer.NewCodecFactory(scheme)}
-
-	client, err := rest.RESTClientFor(&config)
-	if err != nil {
-		return nil, nil, err
-	}
-	return client, scheme, nil
-}
-
-func MakeCrdClient(cl *rest.RESTClient, scheme *runtime.Scheme, namespace string) *CrdClient {
-	return &CrdClient{cl: cl, ns: namespace, plural: CRDPlural,
-		codec: runtime.NewParameterCodec(scheme)}
-}
-
-// +k8s:deepcopy-gen=false
-type CrdClient struct {
-	cl     *rest.RESTClient
-	ns     string
-	plural string
-	codec  runtime.ParameterCodec
-}
-
-func (f *CrdClient) Create(obj *PRPUser) (*PRPUser, error) {
-	var result PRPUser
-	err := f.cl.Post().
-		Namespace(f.ns).Resource(f.plural).
-		Body(obj).Do().Into(&result)
-	return &result, err
-}
-
-func (f *CrdClient) Update(obj *PRPUser) (*PRPUser, error) {
-	var result PRPUser
-	err := f.cl.Put().
-		Namespace(f.ns).Resource(f.plural).Name(obj.Name).
-		Body(obj).Do().Into(&result)
-	return &result, err
-}
-
-func (f *CrdClient) Delete(name string, options *meta_v1.DeleteOptions) error {
-	return f.cl.Delete().
-		Namespace(f.ns).Resource(f.plural).
-		Name(name).Body(options).Do().
-		Error()
-}
-
-func (f *CrdClient) Get(name string) (*PRPUser, error) {
-	var result PRPUser
-	err := f.cl.Get().
-		Namespace(f.ns).Resource(f.plural).
-		Name(name).Do().Into(&result)
-	return &result, err
-}
-
-func (f *CrdClient) List(opts meta_v1.ListOptions) (*PRPUserList, error) {
-	var result PRPUserList
-	err := f.cl.Get().
-		Namespace(f.ns).Resource(f.plural).
-		VersionedParams(&opts, f.codec).
-		Do().Into(&result)
-	return &result, err
-}
-
-// Create a new List watch for our TPR
-func (f *CrdClient) NewListWatch() *cache.ListWatch {
-	return cache.NewListWatchFromClient(f.cl, f.plural, f.ns, fields.Everything())
-}
@@ -1,23 +1,19 @@
 package v1alpha1
 
 import (
-	"strings"
-
-	authv1 "k8s.io/api/authorization/v1"
-
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 // +genclient
-// +genclient:noStatus
+// +genclient:nonNamespaced
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
+// PRPUser is the user as stored before v1. Only used to migrate the existing objects to v1.PRPUser.
 type PRPUser struct {
 	meta_v1.TypeMeta   `json:",inline"`
 	meta_v1.ObjectMeta `json:"metadata"`
-	Spec               PRPUserSpec `json:"spec"`
+	Spec               PRPUserSpec   `json:"spec"`
+	Status             PRPUserStatus `json:"status,omitempty"`
 }
 
 type PRPUserSpec struct {
@@ -29,6 +25,15 @@ type PRPUserSpec struct {
 	Role   string `json:""` // guest, user, admin
 }
 
+// PRPUserStatus is the user activity in the portal
+type PRPUserStatus struct {
+	FirstLogin         *meta_v1.Time `json:",omitempty"`
+	LastLogin          *meta_v1.Time `json:",omitempty"`
+	LastConfigDownload *meta_v1.Time `json:",omitempty"`
+	LastIDP            string        `json:",omitempty"`
+	Namespaces         []string      `json:",omitempty"` // namespaces the user is bound to in the primary cluster
+}
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // PRPUserList is a list of PRP users
@@ -38,43 +43,35 @@ type PRPUserList struct {
 	Items            []PRPUser `json:"items"`
 }
 
-func (user PRPUser) GetUserClientset() (*kubernetes.Clientset, error) {
-	userk8sconfig, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	userk8sconfig.Impersonate = rest.ImpersonationConfig{
-		UserName: user.Spec.UserID,
-	}
-
-	return kubernetes.NewForConfig(userk8sconfig)
+// +genclient
+// +genclient:nonNamespaced
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
+// NamespaceMembershipRequest is a request of a user to join a namespace
+type NamespaceMembershipRequest struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               NamespaceMembershipRequestSpec `json:"spec"`
 }
 
-func (user PRPUser) IsGuest() bool {
-	return strings.ToLower(user.Spec.Role) == "guest"
+type NamespaceMembershipRequestSpec struct {
+	Namespace  string `json:""`
+	UserID     string `json:""`
+	Comment    string `json:""`
+	State      string `json:""` // pending, approved, denied
+	ReviewedBy string `json:""`
 }
 
-// Check if user can create accounts in the NS - so is he an admin
-func (user PRPUser) IsAdmin(ns string) bool {
-	userclientset, err := user.GetUserClientset()
-	if err != nil {
-		return false
-	}
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
-	if rev, err := userclientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authv1.SelfSubjectAccessReview{
-		Spec: authv1.SelfSubjectAccessReviewSpec{
-			ResourceAttributes: &authv1.ResourceAttributes{
-				Namespace: ns,
-				Verb:      "create",
-				Group:     "rbac.authorization.k8s.io",
-				Resource:  "rolebindings",
-			},
-		},
-	}); err == nil {
-		return rev.Status.Allowed
-	}
+// NamespaceMembershipRequestList is a list of namespace membership requests
+type NamespaceMembershipRequestList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata"`
+	Items            []NamespaceMembershipRequest `json:"items"`
+}
 
-	return false
+func (req NamespaceMembershipRequest) IsPending() bool {
+	return req.Spec.State == "" || req.Spec.State == "pending"
 }
@@ -8,54 +8,38 @@ import (
 	"strings"
 	"time"
 
-	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
 	v1 "k8s.io/api/core/v1"
 
 	authv1 "k8s.io/api/authorization/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
-	apiextcs "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
 
 type ProfileTemplateVars struct {
 	IndexTemplateVars
-	NamespaceBindings []NamespaceUserBinding
-	PRPUsers          []nautilusapi.PRPUser
+	NamespaceBindings  []NamespaceUserBinding
+	PRPUsers           []nautilusapi.PRPUser
+	NamespaceTemplates []nautilusapi.NamespaceTemplate
+	NsMetaFields       []NsMetaField
 }
 
 type NamespaceUserBinding struct {
-	Namespace v1.Namespace
-	ConfigMap v1.ConfigMap
+	Namespace   v1.Namespace
+	Metadata    map[string]string
+	Expires     string
+	Archived    bool
+	DeleteAfter string
 }
 
-func GetCrd() {
-	k8sconfig, err := rest.InClusterConfig()
-	if err != nil {
-		log.Fatal("Failed to do inclusterconfig: " + err.Error())
-		return
-	}
-
-	crdclientset, err := apiextcs.NewForConfig(k8sconfig)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	if err := nautilusapi.CreateCRD(crdclientset); err != nil {
-		log.Printf("Error creating CRD: %s", err.Error())
-	}
-
-	// Wait for the CRD to be created before we use it (only needed if its a new one)
-	time.Sleep(3 * time.Second)
-
-	_, controller := cache.NewInformer(
-		crdclient.NewListWatch(),
-		&nautilusapi.PRPUser{},
-		time.Minute*5,
+// Keeps the users cluster privileges in sync with the PRPUser objects from the shared informer,
+// and cleans up the role bindings of the deleted users
+func (s *Server) WatchUsers() {
+	s.userInformer.AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				user, ok := obj.(*nautilusapi.PRPUser)
@@ -64,7 +48,12 @@ func GetCrd() {
 					return
 				}
 
-				updateClusterUserPrivileges(user)
+				if err := s.syncUserFinalizer(user); err != nil {
+					log.Printf("Error finalizing user %s: %s", user.Name, err.Error())
+				}
+				if user.DeletionTimestamp == nil {
+					s.updateClusterUserPrivileges(user)
+				}
 			},
 			DeleteFunc: func(obj interface{}) {
 				user, ok := obj.(*nautilusapi.PRPUser)
@@ -73,23 +62,9 @@ func GetCrd() {
 					return
 				}
 
-				if rb, err := clientset.Rbac().ClusterRoleBindings().Get("nautilus-cluster-user", metav1.GetOptions{}); err == nil {
-					allSubjects := []rbacv1.Subject{} // to filter the user, in case we need to delete one
-
-					found := false
-					for _, subj := range rb.Subjects {
-						if subj.Name == user.Spec.UserID {
-							found = true
-						} else {
-							allSubjects = append(allSubjects, subj)
-						}
-					}
-					if found {
-						rb.Subjects = allSubjects
-						if _, err := clientset.Rbac().ClusterRoleBindings().Update(rb); err != nil {
-							log.Printf("Error updating user %s: %s", user.Name, err.Error())
-						}
-					}
+				// Users deleted without the finalizer
+				if err := s.cleanupUserBindings(user.Spec.UserID); err != nil {
+					log.Printf("Error cleaning up the bindings of user %s: %s", user.Name, err.Error())
 				}
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
@@ -103,21 +78,30 @@ func GetCrd() {
 					log.Printf("Expected PRPUser but other received %#v", newObj)
 					return
 				}
-				if oldUser.Spec.Role != newUser.Spec.Role {
-					updateClusterUserPrivileges(newUser)
+				if err := s.syncUserFinalizer(newUser); err != nil {
+					log.Printf("Error finalizing user %s: %s", newUser.Name, err.Error())
+				}
+				if oldUser.Spec.Role != newUser.Spec.Role && newUser.DeletionTimestamp == nil {
+					s.updateClusterUserPrivileges(newUser)
 				}
 			},
 		},
 	)
+}
 
-	stop := make(chan struct{})
-	go controller.Run(stop)
-
-	// Wait forever
-	select {}
+// Updates the user's cluster privileges in all clusters, going on past the failed ones
+func (s *Server) updateClusterUserPrivileges(user *nautilusapi.PRPUser) error {
+	var lastErr error
+	for _, cluster := range s.clusters {
+		if err := updateClusterUserBinding(cluster.clientset, user); err != nil {
+			log.Printf("Error updating privileges of user %s in cluster %s: %s", user.Name, cluster.Name, err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
-func updateClusterUserPrivileges(user *nautilusapi.PRPUser) error {
+func updateClusterUserBinding(clientset kubernetes.Interface, user *nautilusapi.PRPUser) error {
 	allSubjects := []rbacv1.Subject{} // to filter the user, in case we need to delete one
 
 	if rb, err := clientset.Rbac().ClusterRoleBindings().Get("nautilus-cluster-user", metav1.GetOptions{}); err == nil {
@@ -165,13 +149,13 @@ func updateClusterUserPrivileges(user *nautilusapi.PRPUser) error {
 }
 
 // Process the /profile path
-func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ProfileHandler(w http.ResponseWriter, r *http.Request) {
 
-	if r.Method != "GET" {
+	if r.Method != "GET" && r.Method != "POST" {
 		return
 	}
 
-	session, err := filestore.Get(r, "prp-session")
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -181,7 +165,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUser(session.Values["userid"].(string))
+	user, err := s.GetUser(session.Values["userid"].(string))
 	if err != nil {
 		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 		session.Save(r, w)
@@ -189,7 +173,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userclientset, err := user.GetUserClientset()
+	userclientset, err := s.clusters[0].GetUserClientset(user)
 	if err != nil {
 		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 		session.Save(r, w)
@@ -197,7 +181,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if strings.ToLower(user.Spec.Role) != "admin" {
+	if user.Spec.Role != nautilusapi.RoleAdmin {
 		session.AddFlash("Only admins can manage namespaces")
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -205,21 +189,36 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// User requested to create a new namespace
-	var createNsName = r.URL.Query().Get("mkns")
+	var createNsName = r.PostFormValue("mkns")
 	if createNsName != "" {
-		if ns, err := clientset.Core().Namespaces().List(metav1.ListOptions{
-			FieldSelector: fields.OneTermEqualSelector("metadata.name", createNsName).String()}); len(ns.Items) == 0 && err == nil {
-			if _, err := clientset.Core().Namespaces().Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: createNsName}}); err != nil {
+		if tmpl, err := s.getNamespaceTemplate(r.PostFormValue("template")); err != nil {
+			session.AddFlash(fmt.Sprintf("Error getting the namespace template: %s", err.Error()))
+			session.Save(r, w)
+		} else if _, err := s.clientset.Core().Namespaces().Get(createNsName, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+			ns := templateNamespace(createNsName, tmpl)
+			if expires := newNsExpires(time.Now()); expires != nil {
+				ns.Annotations[nsExpiresAnnotation] = expires.Format(nsExpiresFormat)
+			}
+			if _, err := s.clientset.Core().Namespaces().Create(ns); err != nil {
 				session.AddFlash(fmt.Sprintf("Error creating the namespace: %s", err.Error()))
 				session.Save(r, w)
 			} else {
-				if _, err := createNsLimits(createNsName); err != nil {
+				if tmpl != nil {
+					for _, err := range s.applyNamespaceTemplate(createNsName, tmpl) {
+						log.Printf("Error applying the namespace template: %s", err.Error())
+						session.AddFlash(err.Error())
+						session.Save(r, w)
+					}
+				} else if _, err := s.createNsLimits(createNsName); err != nil {
 					log.Printf("Error creating limits: %s", err.Error())
 				}
 
-				if err := createNsRoleBinding(createNsName, user, clientset); err != nil {
+				if err := s.addNamespaceMember(createNsName, user, nautilusapi.NamespaceRoleAdmin); err != nil {
 					log.Printf("Error creating userbinding %s", err.Error())
+				} else {
+					s.recordUserNamespace(user.Spec.UserID, createNsName)
 				}
+				s.audit(r, user, auditNamespaceCreate, createNsName, createNsName, nil, r.PostFormValue("template"))
 			}
 		} else {
 			session.AddFlash(fmt.Sprintf("The namespace %s already exists or error %v", createNsName, err))
@@ -227,29 +226,13 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// User requested to delete a new namespace
-	var delNsName = r.URL.Query().Get("delns")
-	if delNsName != "" {
-		if strings.HasPrefix(delNsName, "kube-") || delNsName == "default" {
-			session.AddFlash(fmt.Sprintf("Can't delete standard namespace %s", delNsName))
-			session.Save(r, w)
-		} else {
-			if err := userclientset.Core().Namespaces().Delete(delNsName, &metav1.DeleteOptions{}); err != nil {
-				session.AddFlash(fmt.Sprintf("Error deleting the namespace: %s", err.Error()))
-				session.Save(r, w)
-			} else {
-				session.AddFlash(fmt.Sprintf("The namespace %s is being deleted. Please update the page or use kubectl to see the result.", delNsName))
-				session.Save(r, w)
-			}
-		}
-	}
-
 	// User requested to add another user to namespace
-	addUserName := r.URL.Query().Get("addusername")
-	addUserNs := r.URL.Query().Get("adduserns")
+	addUserName := r.PostFormValue("addusername")
+	addUserNs := r.PostFormValue("adduserns")
+	addUserRole := r.PostFormValue("adduserrole")
 
 	if addUserName != "" && addUserNs != "" {
-		requser, err := GetUser(addUserName)
+		requser, err := s.GetUser(addUserName)
 		if err != nil {
 			session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 			session.Save(r, w)
@@ -257,21 +240,33 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := createNsRoleBinding(addUserNs, requser, userclientset); err != nil {
+		oldRole := s.namespaceMemberRole(addUserNs, requser.Spec.UserID)
+		if !s.clusters[0].IsNamespaceAdmin(user, addUserNs) {
+			session.AddFlash(fmt.Sprintf("You're not an admin of namespace %s", addUserNs))
+			session.Save(r, w)
+		} else if !isNamespaceRole(addUserRole) {
+			session.AddFlash(fmt.Sprintf("Unknown namespace role '%s'", addUserRole))
+			session.Save(r, w)
+		} else if requser.IsGuest() {
+			session.AddFlash(fmt.Sprintf("User %s has to be validated before joining a namespace", requser.Spec.Email))
+			session.Save(r, w)
+		} else if err := s.addNamespaceMember(addUserNs, requser, addUserRole); err != nil {
 			session.AddFlash(fmt.Sprintf("Error adding user to namespace: %s", err.Error()))
 			session.Save(r, w)
 		} else {
-			session.AddFlash(fmt.Sprintf("Added user %s with role '%s' to namespace %s.", requser.Spec.Email, requser.Spec.Role, addUserNs))
+			s.audit(r, user, auditMemberAdd, requser.Spec.UserID, addUserNs, oldRole, addUserRole)
+			s.recordUserNamespace(requser.Spec.UserID, addUserNs)
+			session.AddFlash(fmt.Sprintf("Added user %s with role '%s' to namespace %s.", requser.Spec.Email, addUserRole, addUserNs))
 			session.Save(r, w)
 		}
 	}
 
 	// User requested to delete another user from namespace
-	delUserName := r.URL.Query().Get("delusername")
-	delUserNs := r.URL.Query().Get("deluserns")
+	delUserName := r.PostFormValue("delusername")
+	delUserNs := r.PostFormValue("deluserns")
 
 	if delUserName != "" && delUserNs != "" {
-		requser, err := GetUser(delUserName)
+		requser, err := s.GetUser(delUserName)
 		if err != nil {
 			session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 			session.Save(r, w)
@@ -279,26 +274,56 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := delNsRoleBinding(delUserNs, requser, userclientset); err != nil {
+		oldRole := s.namespaceMemberRole(delUserNs, requser.Spec.UserID)
+		if !s.clusters[0].IsNamespaceAdmin(user, delUserNs) {
+			session.AddFlash(fmt.Sprintf("You're not an admin of namespace %s", delUserNs))
+			session.Save(r, w)
+		} else if err := s.removeNamespaceMember(delUserNs, requser.Spec.UserID); err != nil {
 			session.AddFlash(fmt.Sprintf("Error deleting user from namespace %s: %s", delUserNs, err.Error()))
 			session.Save(r, w)
 		} else {
+			s.audit(r, user, auditMemberRemove, requser.Spec.UserID, delUserNs, oldRole, nil)
+			s.forgetUserNamespace(requser.Spec.UserID, delUserNs)
 			session.AddFlash(fmt.Sprintf("Deleted user %s from namespace %s.", requser.Spec.Email, delUserNs))
 			session.Save(r, w)
 		}
 	}
 
-	if delNsName != "" || createNsName != "" || addUserName != "" || delUserName != "" {
+	// User requested to renew the namespace
+	renewNsName := r.PostFormValue("renewns")
+	if renewNsName != "" {
+		before := s.nsAuditState(renewNsName)
+		if !s.clusters[0].IsNamespaceAdmin(user, renewNsName) {
+			session.AddFlash(fmt.Sprintf("You're not an admin of namespace %s", renewNsName))
+			session.Save(r, w)
+		} else if err := s.renewNamespace(renewNsName, time.Now()); err != nil {
+			session.AddFlash(fmt.Sprintf("Error renewing namespace %s: %s", renewNsName, err.Error()))
+			session.Save(r, w)
+		} else {
+			s.audit(r, user, auditNamespaceRenew, renewNsName, renewNsName, before, s.nsAuditState(renewNsName))
+			session.AddFlash(fmt.Sprintf("Renewed namespace %s.", renewNsName))
+			session.Save(r, w)
+		}
+	}
+
+	// The changes are only made with POST, and the page is reloaded to show them
+	if r.Method == "POST" {
 		http.Redirect(w, r, "/profile", 303)
 		return
 	}
 
-	namespacesList, _ := clientset.Core().Namespaces().List(metav1.ListOptions{})
+	namespacesList, _ := s.clientset.Core().Namespaces().List(metav1.ListOptions{})
 
 	nsList := []NamespaceUserBinding{}
 
 	for _, ns := range namespacesList.Items {
-		nsBind := NamespaceUserBinding{Namespace: ns}
+		nsBind := NamespaceUserBinding{Namespace: ns, Metadata: nsMetadata(&ns), Archived: nsArchived(&ns)}
+		if expires := nsExpires(&ns); expires != nil {
+			nsBind.Expires = expires.Format(nsExpiresFormat)
+		}
+		if deleteAfter := nsDeleteAfter(&ns); deleteAfter != nil {
+			nsBind.DeleteAfter = deleteAfter.Format(nsExpiresFormat)
+		}
 		if rev, err := userclientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authv1.SelfSubjectAccessReview{
 			Spec: authv1.SelfSubjectAccessReviewSpec{
 				ResourceAttributes: &authv1.ResourceAttributes{
@@ -310,17 +335,19 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			},
 		}); err == nil {
 			if rev.Status.Allowed {
-				if metaConfig, err := clientset.CoreV1().ConfigMaps(ns.GetName()).Get("meta", metav1.GetOptions{}); err == nil {
-					nsBind.ConfigMap = *metaConfig
-				}
 				nsList = append(nsList, nsBind)
 			}
 		}
 	}
 
-	usersList, _ := crdclient.List(metav1.ListOptions{})
+	usersList, _ := s.users.List(metav1.ListOptions{})
 
-	nsVars := ProfileTemplateVars{NamespaceBindings: nsList, PRPUsers: usersList.Items, IndexTemplateVars: buildIndexTemplateVars(session, w, r)}
+	nsVars := ProfileTemplateVars{NamespaceBindings: nsList, PRPUsers: usersList.Items, NsMetaFields: nsMetaFields(), IndexTemplateVars: s.buildIndexTemplateVars(session, w, r)}
+	if templatesList, err := s.namespaceTemplates.List(metav1.ListOptions{}); err == nil {
+		nsVars.NamespaceTemplates = templatesList.Items
+	} else {
+		log.Printf("Error getting the namespace templates: %s", err.Error())
+	}
 
 	t, err := template.New("layout.tmpl").ParseFiles("templates/layout.tmpl", "templates/profile.tmpl")
 	if err != nil {
@@ -333,8 +360,8 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func NsMetaHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := filestore.Get(r, "prp-session")
+func (s *Server) NsMetaHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -344,7 +371,7 @@ func NsMetaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUser(session.Values["userid"].(string))
+	user, err := s.GetUser(session.Values["userid"].(string))
 	if err != nil {
 		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 		session.Save(r, w)
@@ -352,18 +379,15 @@ func NsMetaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userclientset, err := user.GetUserClientset()
-	if err != nil {
-		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+	if user.Spec.Role != nautilusapi.RoleAdmin {
+		session.AddFlash("Only admins can manage namespaces")
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	if strings.ToLower(user.Spec.Role) != "admin" {
-		session.AddFlash("Only admins can manage namespaces")
-		session.Save(r, w)
-		http.Redirect(w, r, "/", http.StatusFound)
+	if r.Method == http.MethodGet && r.URL.Query().Get("format") == "csv" {
+		s.writeNsMetaCsv(w)
 		return
 	}
 
@@ -374,244 +398,69 @@ func NsMetaHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	updateNsName := r.PostFormValue("pk")
-	if updateNsName != "" {
-		if confMap, err := userclientset.Core().ConfigMaps(updateNsName).Get("meta", metav1.GetOptions{}); err == nil {
-			switch r.PostFormValue("name") {
-			case "PI":
-				confMap.Data["PI"] = r.PostFormValue("value")
-			case "Grant":
-				confMap.Data["Grant"] = r.PostFormValue("value")
-			}
-			if _, err := userclientset.Core().ConfigMaps(updateNsName).Update(confMap); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-				return
-			}
-		} else {
-			dataMap := map[string]string{"PI": "", "Grant": ""}
-			switch r.PostFormValue("name") {
-			case "PI":
-				dataMap["PI"] = r.PostFormValue("value")
-			case "Grant":
-				dataMap["Grant"] = r.PostFormValue("value")
-			}
-			if _, err := userclientset.Core().ConfigMaps(updateNsName).Create(&v1.ConfigMap{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "meta",
-				},
-				Data: dataMap,
-			}); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
-				return
-			}
-		}
-	}
-}
-
-// Creates a new rolebinding
-func createNsRoleBinding(nsName string, user *nautilusapi.PRPUser, userclientset *kubernetes.Clientset) error {
-	if rb, err := userclientset.Rbac().RoleBindings(nsName).Get("psp:nautilus-user", metav1.GetOptions{}); err == nil {
-		found := false
-		for _, subj := range rb.Subjects {
-			if subj.Name == user.Spec.UserID {
-				found = true
-			}
-		}
-		if !found {
-			rb.Subjects = append(rb.Subjects, rbacv1.Subject{
-				Kind:     "User",
-				APIGroup: "rbac.authorization.k8s.io",
-				Name:     user.Spec.UserID})
-			if _, err := userclientset.Rbac().RoleBindings(nsName).Update(rb); err != nil {
-				return err
-			}
-		}
-	} else {
-		if _, err := userclientset.Rbac().RoleBindings(nsName).Create(&rbacv1.RoleBinding{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: "psp:nautilus-user",
-			},
-			RoleRef: rbacv1.RoleRef{
-				APIGroup: "rbac.authorization.k8s.io",
-				Kind:     "ClusterRole",
-				Name:     "psp:nautilus-user",
-			},
-			Subjects: []rbacv1.Subject{
-				{
-					Kind: "ServiceAccount",
-					Name: "default"},
-				{
-					Kind:     "User",
-					APIGroup: "rbac.authorization.k8s.io",
-					Name:     user.Spec.UserID},
-			},
-		}); err != nil {
-			return err
-		}
+	if updateNsName == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The namespace is not set"))
+		return
 	}
 
-	if user.Spec.Role == "admin" {
-		if rb, err := userclientset.Rbac().RoleBindings(nsName).Get("nautilus-admin-ext", metav1.GetOptions{}); err == nil {
-			found := false
-			for _, subj := range rb.Subjects {
-				if subj.Name == user.Spec.UserID {
-					found = true
-				}
-			}
-			if !found {
-				rb.Subjects = append(rb.Subjects, rbacv1.Subject{
-					Kind:     "User",
-					APIGroup: "rbac.authorization.k8s.io",
-					Name:     user.Spec.UserID})
-				if _, err := userclientset.Rbac().RoleBindings(nsName).Update(rb); err != nil {
-					return err
-				}
-			}
-		} else {
-			if _, err := userclientset.Rbac().RoleBindings(nsName).Create(&rbacv1.RoleBinding{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "nautilus-admin-ext",
-				},
-				RoleRef: rbacv1.RoleRef{
-					APIGroup: "rbac.authorization.k8s.io",
-					Kind:     "ClusterRole",
-					Name:     "nautilus-admin",
-				},
-				Subjects: []rbacv1.Subject{{
-					Kind:     "User",
-					APIGroup: "rbac.authorization.k8s.io",
-					Name:     user.Spec.UserID}},
-			}); err != nil {
-				return err
-			}
-		}
+	if !s.clusters[0].IsNamespaceAdmin(user, updateNsName) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("You're not an admin of namespace %s", updateNsName)))
+		return
 	}
 
-	if rb, err := userclientset.Rbac().RoleBindings(nsName).Get("nautilus-"+user.Spec.Role, metav1.GetOptions{}); err == nil {
-		found := false
-		for _, subj := range rb.Subjects {
-			if subj.Name == user.Spec.UserID {
-				found = true
-			}
+	// The expiration date is kept in the namespace
+	if r.PostFormValue("name") == "Expires" {
+		expires, err := time.Parse(nsExpiresFormat, r.PostFormValue("value"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("The date should be in YYYY-MM-DD format"))
+			return
 		}
-		if !found {
-			rb.Subjects = append(rb.Subjects, rbacv1.Subject{
-				Kind:     "User",
-				APIGroup: "rbac.authorization.k8s.io",
-				Name:     user.Spec.UserID})
-			_, err := userclientset.Rbac().RoleBindings(nsName).Update(rb)
-			return err
+		if err := validNsExpires(expires, time.Now()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
 		}
-	} else {
-		clusterRoleName := ""
-		switch user.Spec.Role {
-		case "user":
-			clusterRoleName = "edit"
-		case "admin":
-			clusterRoleName = "admin"
+		before := s.nsAuditState(updateNsName)
+		if err := s.setNsExpires(updateNsName, expires); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
 		}
-		_, err := userclientset.Rbac().RoleBindings(nsName).Create(&rbacv1.RoleBinding{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: "nautilus-" + user.Spec.Role,
-			},
-			RoleRef: rbacv1.RoleRef{
-				APIGroup: "rbac.authorization.k8s.io",
-				Kind:     "ClusterRole",
-				Name:     clusterRoleName,
-			},
-			Subjects: []rbacv1.Subject{{
-				Kind:     "User",
-				APIGroup: "rbac.authorization.k8s.io",
-				Name:     user.Spec.UserID}},
-		})
-		return err
+		s.audit(r, user, auditNamespaceExpires, updateNsName, updateNsName, before, s.nsAuditState(updateNsName))
+		return
 	}
-	return nil
 
-}
-
-// Deletes a rolebinding
-func delNsRoleBinding(nsName string, user *nautilusapi.PRPUser, userclientset *kubernetes.Clientset) error {
-	if rb, err := userclientset.Rbac().RoleBindings(nsName).Get("psp:nautilus-user", metav1.GetOptions{}); err == nil {
-		allSubjects := []rbacv1.Subject{} // to filter the user, in case we need to delete one
-		found := false
-		for _, subj := range rb.Subjects {
-			if subj.Name == user.Spec.UserID {
-				found = true
-			} else {
-				allSubjects = append(allSubjects, subj)
-			}
-		}
-		if found {
-			if len(allSubjects) == 0 {
-				if err := userclientset.Rbac().RoleBindings(nsName).Delete(rb.GetName(), &metav1.DeleteOptions{}); err != nil {
-					return err
-				}
-			} else {
-				rb.Subjects = allSubjects
-				if _, err := userclientset.Rbac().RoleBindings(nsName).Update(rb); err != nil {
-					return err
-				}
-			}
-		}
+	field := getNsMetaField(r.PostFormValue("name"))
+	if field == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Unknown namespace metadata field %s", r.PostFormValue("name"))))
+		return
 	}
-
-	if user.Spec.Role == "admin" {
-		if rb, err := userclientset.Rbac().RoleBindings(nsName).Get("nautilus-admin-ext", metav1.GetOptions{}); err == nil {
-			allSubjects := []rbacv1.Subject{} // to filter the user, in case we need to delete one
-			found := false
-			for _, subj := range rb.Subjects {
-				if subj.Name == user.Spec.UserID {
-					found = true
-				} else {
-					allSubjects = append(allSubjects, subj)
-				}
-			}
-			if found {
-				if len(allSubjects) == 0 {
-					if err := userclientset.Rbac().RoleBindings(nsName).Delete(rb.GetName(), &metav1.DeleteOptions{}); err != nil {
-						return err
-					}
-				} else {
-					rb.Subjects = allSubjects
-					if _, err := userclientset.Rbac().RoleBindings(nsName).Update(rb); err != nil {
-						return err
-					}
-				}
-			}
-		}
+	value := strings.TrimSpace(r.PostFormValue("value"))
+	if err := field.validate(value); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
-
-	if rb, err := userclientset.Rbac().RoleBindings(nsName).Get("nautilus-"+user.Spec.Role, metav1.GetOptions{}); err == nil {
-		allSubjects := []rbacv1.Subject{} // to filter the user, in case we need to delete one
-		found := false
-		for _, subj := range rb.Subjects {
-			if subj.Name == user.Spec.UserID {
-				found = true
-			} else {
-				allSubjects = append(allSubjects, subj)
-			}
-		}
-		if found {
-			if len(allSubjects) == 0 {
-				if err := userclientset.Rbac().RoleBindings(nsName).Delete(rb.GetName(), &metav1.DeleteOptions{}); err != nil {
-					return err
-				}
-			} else {
-				rb.Subjects = allSubjects
-				_, err := userclientset.Rbac().RoleBindings(nsName).Update(rb)
-				return err
-			}
-		}
+	before := ""
+	if ns, err := s.clientset.Core().Namespaces().Get(updateNsName, metav1.GetOptions{}); err == nil {
+		before = nsMetadata(ns)[field.Name]
 	}
-	return nil
+	if err := s.setNsMeta(updateNsName, field.Name, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.audit(r, user, auditNamespaceMetadata, updateNsName, updateNsName, map[string]string{field.Name: before}, map[string]string{field.Name: value})
 }
 
 // Creates a namespace default limits
-func createNsLimits(ns string) (*v1.LimitRange, error) {
-	return clientset.Core().LimitRanges(ns).Create(&v1.LimitRange{
-		ObjectMeta: metav1.ObjectMeta{Name: ns + "-mem"},
+func (s *Server) createNsLimits(ns string) (*v1.LimitRange, error) {
+	return s.clientset.Core().LimitRanges(ns).Create(&v1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{Name: nsLimitsName(ns)},
 		Spec: v1.LimitRangeSpec{
 			Limits: []v1.LimitRangeItem{
 				{
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/viper"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The resource quota the portal manages in the namespaces
+const nsQuotaName = "nautilus-quota"
+
+// The resources of the quota that can be edited from the portal
+var quotaResources = []struct {
+	Name  v1.ResourceName
+	Title string
+}{
+	{v1.ResourceRequestsCPU, "CPU requests"},
+	{v1.ResourceLimitsCPU, "CPU limits"},
+	{v1.ResourceRequestsMemory, "Memory requests"},
+	{v1.ResourceLimitsMemory, "Memory limits"},
+	{v1.ResourceName(v1.DefaultResourceRequestsPrefix + "nvidia.com/gpu"), "GPUs"},
+	{v1.ResourceRequestsStorage, "Storage requests"},
+	{v1.ResourcePersistentVolumeClaims, "Persistent volume claims"},
+	{v1.ResourcePods, "Pods"},
+	{v1.ResourceServices, "Services"},
+	{v1.ResourceConfigMaps, "Config maps"},
+	{v1.ResourceSecrets, "Secrets"},
+}
+
+// The container defaults of the namespace limit range that can be edited from the portal,
+// with the quota resources bounding them
+var limitDefaults = []struct {
+	Field   string
+	Title   string
+	Name    v1.ResourceName
+	Request bool
+	Ceiling v1.ResourceName
+}{
+	{"default:cpu", "Default CPU limit", v1.ResourceCPU, false, v1.ResourceLimitsCPU},
+	{"defaultRequest:cpu", "Default CPU request", v1.ResourceCPU, true, v1.ResourceRequestsCPU},
+	{"default:memory", "Default memory limit", v1.ResourceMemory, false, v1.ResourceLimitsMemory},
+	{"defaultRequest:memory", "Default memory request", v1.ResourceMemory, true, v1.ResourceRequestsMemory},
+}
+
+type QuotaResource struct {
+	Field   string
+	Title   string
+	Used    string
+	Hard    string
+	Ceiling string
+}
+
+type QuotaTemplateVars struct {
+	IndexTemplateVars
+	Namespace string
+	Quota     []QuotaResource
+	Limits    []QuotaResource
+}
+
+// Returns the name of the limit range the portal creates in the namespace
+func nsLimitsName(ns string) string {
+	return ns + "-mem"
+}
+
+// Returns the maximum quota values namespace admins can set, from the quota_ceilings config table
+func quotaCeilings() v1.ResourceList {
+	ceilings := v1.ResourceList{}
+	for name, value := range viper.GetStringMapString("quota_ceilings") {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			log.Printf("Error parsing the quota ceiling %s: %s", name, err.Error())
+			continue
+		}
+		ceilings[v1.ResourceName(name)] = quantity
+	}
+	return ceilings
+}
+
+// Returns the quota managed by the portal in the namespace, or nil if there's none
+func (s *Server) getNsQuota(ns string) (*v1.ResourceQuota, error) {
+	quota, err := s.clientset.Core().ResourceQuotas(ns).Get(nsQuotaName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return quota, err
+}
+
+// Sets the hard limits of the namespace quota. The quota is deleted when there are no limits,
+// unless the quota ceilings are set.
+func (s *Server) updateNsQuota(ns string, hard v1.ResourceList) error {
+	if len(hard) == 0 && len(quotaCeilings()) > 0 {
+		return fmt.Errorf("The quota can't be removed while the quota maximums are set")
+	}
+
+	quota, err := s.getNsQuota(ns)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case quota == nil && len(hard) == 0:
+		return nil
+	case quota == nil:
+		_, err = s.clientset.Core().ResourceQuotas(ns).Create(&v1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: nsQuotaName},
+			Spec:       v1.ResourceQuotaSpec{Hard: hard},
+		})
+	case len(hard) == 0:
+		err = s.clientset.Core().ResourceQuotas(ns).Delete(nsQuotaName, &metav1.DeleteOptions{})
+	default:
+		quota.Spec.Hard = hard
+		_, err = s.clientset.Core().ResourceQuotas(ns).Update(quota)
+	}
+	return err
+}
+
+// Returns the container limits of the namespace limit range, or nil if there's none
+func (s *Server) getNsLimits(ns string) (*v1.LimitRangeItem, error) {
+	limitRange, err := s.clientset.Core().LimitRanges(ns).Get(nsLimitsName(ns), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i := range limitRange.Spec.Limits {
+		if limitRange.Spec.Limits[i].Type == v1.LimitTypeContainer {
+			return &limitRange.Spec.Limits[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Sets the container defaults of the namespace limit range, keeping the other limits
+func (s *Server) updateNsLimits(ns string, defaults v1.ResourceList, defaultRequests v1.ResourceList) error {
+	limitRange, err := s.clientset.Core().LimitRanges(ns).Get(nsLimitsName(ns), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = s.clientset.Core().LimitRanges(ns).Create(&v1.LimitRange{
+			ObjectMeta: metav1.ObjectMeta{Name: nsLimitsName(ns)},
+			Spec: v1.LimitRangeSpec{
+				Limits: []v1.LimitRangeItem{{
+					Type:           v1.LimitTypeContainer,
+					Default:        defaults,
+					DefaultRequest: defaultRequests,
+				}},
+			},
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range limitRange.Spec.Limits {
+		if limitRange.Spec.Limits[i].Type == v1.LimitTypeContainer {
+			limitRange.Spec.Limits[i].Default = defaults
+			limitRange.Spec.Limits[i].DefaultRequest = defaultRequests
+			found = true
+		}
+	}
+	if !found {
+		limitRange.Spec.Limits = append(limitRange.Spec.Limits, v1.LimitRangeItem{
+			Type:           v1.LimitTypeContainer,
+			Default:        defaults,
+			DefaultRequest: defaultRequests,
+		})
+	}
+	_, err = s.clientset.Core().LimitRanges(ns).Update(limitRange)
+	return err
+}
+
+// Returns an error for the first value over its ceiling
+func checkQuotaCeilings(values v1.ResourceList, ceilings v1.ResourceList) error {
+	for name, value := range values {
+		if ceiling, ok := ceilings[name]; ok && value.Cmp(ceiling) > 0 {
+			return fmt.Errorf("%s of %s is over the maximum of %s", name, value.String(), ceiling.String())
+		}
+	}
+	return nil
+}
+
+// Reads the quantity from the form field. Empty fields are not set.
+func parseQuantityField(r *http.Request, field string, values v1.ResourceList, name v1.ResourceName) error {
+	value := r.PostFormValue(field)
+	if value == "" {
+		return nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return fmt.Errorf("Wrong value %q for %s: %s", value, name, err.Error())
+	}
+	if quantity.Sign() < 0 {
+		return fmt.Errorf("Wrong value %q for %s: can't be negative", value, name)
+	}
+	values[name] = quantity
+	return nil
+}
+
+// Updates the namespace quota and limit range defaults from the form, within the ceilings
+func (s *Server) updateNsQuotaFromForm(ns string, r *http.Request) error {
+	ceilings := quotaCeilings()
+
+	hard := v1.ResourceList{}
+	for _, res := range quotaResources {
+		if err := parseQuantityField(r, "quota:"+string(res.Name), hard, res.Name); err != nil {
+			return err
+		}
+	}
+	// The resources with a maximum can't be unlimited. The ones not on the form get the maximum.
+	for _, res := range quotaResources {
+		if _, ok := hard[res.Name]; !ok {
+			if ceiling, ok := ceilings[res.Name]; ok {
+				return fmt.Errorf("%s needs a value of at most %s", res.Title, ceiling.String())
+			}
+		}
+	}
+	for name, ceiling := range ceilings {
+		if _, ok := hard[name]; !ok {
+			hard[name] = ceiling
+		}
+	}
+	if err := checkQuotaCeilings(hard, ceilings); err != nil {
+		return err
+	}
+
+	defaults := v1.ResourceList{}
+	defaultRequests := v1.ResourceList{}
+	for _, def := range limitDefaults {
+		values := defaults
+		if def.Request {
+			values = defaultRequests
+		}
+		if err := parseQuantityField(r, def.Field, values, def.Name); err != nil {
+			return err
+		}
+		// The defaults can't be over the namespace quota or the ceiling
+		if value, ok := values[def.Name]; ok {
+			if err := checkQuotaCeilings(v1.ResourceList{def.Ceiling: value}, ceilings); err != nil {
+				return err
+			}
+			if err := checkQuotaCeilings(v1.ResourceList{def.Ceiling: value}, hard); err != nil {
+				return err
+			}
+		}
+	}
+	for name, request := range defaultRequests {
+		if limit, ok := defaults[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("The default %s request of %s is over the default limit of %s", name, request.String(), limit.String())
+		}
+	}
+
+	if err := s.updateNsQuota(ns, hard); err != nil {
+		return err
+	}
+	return s.updateNsLimits(ns, defaults, defaultRequests)
+}
+
+// Returns the quota and limit range defaults of the namespace for the page
+func (s *Server) buildQuotaTemplateVars(ns string) ([]QuotaResource, []QuotaResource, error) {
+	ceilings := quotaCeilings()
+	quantityString := func(values v1.ResourceList, name v1.ResourceName) string {
+		if value, ok := values[name]; ok {
+			return value.String()
+		}
+		return ""
+	}
+
+	quota, err := s.getNsQuota(ns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if quota == nil {
+		quota = &v1.ResourceQuota{}
+	}
+	quotaVars := []QuotaResource{}
+	for _, res := range quotaResources {
+		quotaVars = append(quotaVars, QuotaResource{
+			Field:   "quota:" + string(res.Name),
+			Title:   res.Title,
+			Used:    quantityString(quota.Status.Used, res.Name),
+			Hard:    quantityString(quota.Spec.Hard, res.Name),
+			Ceiling: quantityString(ceilings, res.Name),
+		})
+	}
+
+	limits, err := s.getNsLimits(ns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if limits == nil {
+		limits = &v1.LimitRangeItem{}
+	}
+	limitsVars := []QuotaResource{}
+	for _, def := range limitDefaults {
+		values := limits.Default
+		if def.Request {
+			values = limits.DefaultRequest
+		}
+		limitsVars = append(limitsVars, QuotaResource{
+			Field:   def.Field,
+			Title:   def.Title,
+			Hard:    quantityString(values, def.Name),
+			Ceiling: quantityString(ceilings, def.Ceiling),
+		})
+	}
+	return quotaVars, limitsVars, nil
+}
+
+// Returns the quota and limit range defaults of the namespace by the form field, to record in the audit events
+func (s *Server) nsQuotaAuditState(ns string) map[string]string {
+	quotaVars, limitsVars, err := s.buildQuotaTemplateVars(ns)
+	if err != nil {
+		return nil
+	}
+	state := map[string]string{}
+	for _, res := range append(quotaVars, limitsVars...) {
+		if res.Hard != "" {
+			state[res.Field] = res.Hard
+		}
+	}
+	return state
+}
+
+// Process the /quota path
+func (s *Server) QuotaHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
+	if err != nil {
+		log.Printf("Error getting the session: %s", err.Error())
+	}
+
+	if session.IsNew || session.Values["userid"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := s.GetUser(session.Values["userid"].(string))
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	nsName := r.FormValue("namespace")
+	if _, err := s.clientset.Core().Namespaces().Get(nsName, metav1.GetOptions{}); err != nil {
+		session.AddFlash(fmt.Sprintf("Error getting namespace %s: %s", nsName, err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	// Namespace admins can't edit the quota themselves, the portal does it for them
+	if !s.clusters[0].IsNamespaceAdmin(user, nsName) {
+		session.AddFlash(fmt.Sprintf("You're not an admin of namespace %s", nsName))
+		session.Save(r, w)
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		quotaVars, limitsVars, err := s.buildQuotaTemplateVars(nsName)
+		if err != nil {
+			session.AddFlash(fmt.Sprintf("Error getting the quota: %s", err.Error()))
+			session.Save(r, w)
+		}
+
+		t, err := template.New("layout.tmpl").ParseFiles("templates/layout.tmpl", "templates/quota.tmpl")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+		} else {
+			err = t.ExecuteTemplate(w, "layout.tmpl", QuotaTemplateVars{IndexTemplateVars: s.buildIndexTemplateVars(session, w, r), Namespace: nsName, Quota: quotaVars, Limits: limitsVars})
+			if err != nil {
+				w.Write([]byte(err.Error()))
+			}
+		}
+	case "POST":
+		before := s.nsQuotaAuditState(nsName)
+		if err := s.updateNsQuotaFromForm(nsName, r); err != nil {
+			session.AddFlash(fmt.Sprintf("Error updating the quota: %s", err.Error()))
+		} else {
+			s.audit(r, user, auditNamespaceQuota, nsName, nsName, before, s.nsQuotaAuditState(nsName))
+			session.AddFlash(fmt.Sprintf("Updated the quota of namespace %s", nsName))
+		}
+		session.Save(r, w)
+		http.Redirect(w, r, "/quota?"+url.Values{"namespace": {nsName}}.Encode(), http.StatusSeeOther)
+	}
+}
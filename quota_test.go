@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceQuota(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	viper.Set("quota_ceilings", map[string]string{"requests.cpu": "8", "limits.memory": "16Gi"})
+	defer viper.Set("quota_ceilings", nil)
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	env.post(client, "/quota", url.Values{
+		"namespace":             {"test-ns"},
+		"quota:requests.cpu":    {"4"},
+		"quota:limits.memory":   {"8Gi"},
+		"quota:pods":            {"10"},
+		"default:memory":        {"2Gi"},
+		"defaultRequest:memory": {"512Mi"},
+	})
+
+	quota, err := env.k8s.Core().ResourceQuotas("test-ns").Get(nsQuotaName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu := quota.Spec.Hard[v1.ResourceRequestsCPU]; cpu.Cmp(resource.MustParse("4")) != 0 {
+		t.Errorf("Expected the CPU requests quota of 4, got %s", cpu.String())
+	}
+	if len(quota.Spec.Hard) != 3 {
+		t.Errorf("Expected only the set values in the quota, got %v", quota.Spec.Hard)
+	}
+	limits, err := env.server.getNsLimits("test-ns")
+	if err != nil || limits == nil {
+		t.Fatalf("Expected the namespace limit range: %v", err)
+	}
+	if mem := limits.Default[v1.ResourceMemory]; mem.Cmp(resource.MustParse("2Gi")) != 0 {
+		t.Errorf("Expected the default memory limit of 2Gi, got %s", mem.String())
+	}
+	if mem := limits.DefaultRequest[v1.ResourceMemory]; mem.Cmp(resource.MustParse("512Mi")) != 0 {
+		t.Errorf("Expected the default memory request of 512Mi, got %s", mem.String())
+	}
+
+	// Usage is shown with the quota
+	quota.Status.Used = v1.ResourceList{v1.ResourcePods: resource.MustParse("3")}
+	if _, err := env.k8s.Core().ResourceQuotas("test-ns").Update(quota); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := env.get(client, "/quota?namespace=test-ns"); !strings.Contains(body, "<td>3</td>") {
+		t.Errorf("Expected the pods usage in the page, got %s", body)
+	}
+
+	for _, values := range []url.Values{
+		{"quota:requests.cpu": {"16"}},
+		{"default:memory": {"32Gi"}},
+		{"default:memory": {"1Gi"}, "defaultRequest:memory": {"2Gi"}},
+		{"quota:pods": {"lots"}},
+	} {
+		values.Set("namespace", "test-ns")
+		if _, body := env.post(client, "/quota", values); !strings.Contains(body, "Error updating the quota") {
+			t.Errorf("Expected the update %v to be refused", values)
+		}
+	}
+	quota, err = env.k8s.Core().ResourceQuotas("test-ns").Get(nsQuotaName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu := quota.Spec.Hard[v1.ResourceRequestsCPU]; cpu.Cmp(resource.MustParse("4")) != 0 {
+		t.Errorf("Refused update changed the quota to %s", cpu.String())
+	}
+}
+
+func TestQuotaCeilingsNeedValues(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	viper.Set("quota_ceilings", map[string]string{"requests.cpu": "8", "count/jobs.batch": "20"})
+	defer viper.Set("quota_ceilings", nil)
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	env.post(client, "/quota", url.Values{"namespace": {"test-ns"}, "quota:requests.cpu": {"4"}})
+	quota, err := env.server.getNsQuota("test-ns")
+	if err != nil || quota == nil {
+		t.Fatalf("Expected the namespace quota: %v", err)
+	}
+	if jobs := quota.Spec.Hard["count/jobs.batch"]; jobs.Cmp(resource.MustParse("20")) != 0 {
+		t.Errorf("Expected the maximum for the resource not on the form, got %v", quota.Spec.Hard)
+	}
+
+	// Blank fields would leave the resources unlimited
+	for _, values := range []url.Values{
+		{"quota:requests.cpu": {""}, "quota:pods": {"10"}},
+		{"quota:requests.cpu": {""}},
+	} {
+		values.Set("namespace", "test-ns")
+		if _, body := env.post(client, "/quota", values); !strings.Contains(body, "Error updating the quota") {
+			t.Errorf("Expected the update %v to be refused", values)
+		}
+	}
+	quota, err = env.server.getNsQuota("test-ns")
+	if err != nil || quota == nil {
+		t.Fatalf("Expected the namespace quota to be kept: %v", err)
+	}
+	if cpu := quota.Spec.Hard[v1.ResourceRequestsCPU]; cpu.Cmp(resource.MustParse("4")) != 0 {
+		t.Errorf("Refused update changed the quota to %v", quota.Spec.Hard)
+	}
+
+	if err := env.server.updateNsQuota("test-ns", v1.ResourceList{}); err == nil {
+		t.Errorf("Expected the quota not to be removed while the ceilings are set")
+	}
+}
+
+func TestQuotaNeedsNamespaceAdmin(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	admin := env.login(testAdmin)
+	env.post(admin, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(admin, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+
+	user := env.login(testUser)
+	env.post(user, "/quota", url.Values{"namespace": {"test-ns"}, "quota:pods": {"1000"}})
+	if quota, err := env.server.getNsQuota("test-ns"); err != nil || quota != nil {
+		t.Errorf("Editor changed the namespace quota: %v %v", quota, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"sort"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The role bindings the portal manages in the namespaces.
+// nautilus-user is the editors binding named after the global role; it's emptied and deleted on sync.
+var nsRoleBindingNames = []string{"psp:nautilus-user", "nautilus-user", "nautilus-viewer", "nautilus-editor", "nautilus-admin", "nautilus-admin-ext"}
+
+// The cluster roles bound by the namespace role bindings
+var nsRoleBindingRoles = map[string]string{
+	"psp:nautilus-user":  "psp:nautilus-user",
+	"nautilus-user":      "edit",
+	"nautilus-viewer":    "view",
+	"nautilus-editor":    "edit",
+	"nautilus-admin":     "admin",
+	"nautilus-admin-ext": "nautilus-admin",
+}
+
+// Returns the role bindings the namespace member with the role belongs in
+func memberRoleBindings(role string) []string {
+	switch role {
+	case nautilusapi.NamespaceRoleViewer:
+		// Viewers can't run pods, so they don't need the pod security policy
+		return []string{"nautilus-viewer"}
+	case nautilusapi.NamespaceRoleEditor:
+		return []string{"psp:nautilus-user", "nautilus-editor"}
+	case nautilusapi.NamespaceRoleAdmin:
+		return []string{"psp:nautilus-user", "nautilus-admin", "nautilus-admin-ext"}
+	}
+	return nil
+}
+
+func isNsRoleBinding(name string) bool {
+	for _, rbName := range nsRoleBindingNames {
+		if rbName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the subjects without the user, and whether the user was found
+func withoutUserSubject(subjects []rbacv1.Subject, userID string) ([]rbacv1.Subject, bool) {
+	allSubjects := []rbacv1.Subject{}
+	found := false
+	for _, subj := range subjects {
+		if subj.Kind == "User" && subj.Name == userID {
+			found = true
+		} else {
+			allSubjects = append(allSubjects, subj)
+		}
+	}
+	return allSubjects, found
+}
+
+// Sets the User subjects of the portal role binding in the namespace, keeping the other subjects.
+// The binding is created when missing, and deleted when left without subjects.
+func syncRoleBinding(clientset kubernetes.Interface, ns string, rbName string, userIDs []string) error {
+	sorted := append([]string{}, userIDs...)
+	sort.Strings(sorted)
+	userSubjects := []rbacv1.Subject{}
+	for _, userID := range sorted {
+		userSubjects = append(userSubjects, rbacv1.Subject{
+			Kind:     "User",
+			APIGroup: "rbac.authorization.k8s.io",
+			Name:     userID})
+	}
+
+	rb, err := clientset.Rbac().RoleBindings(ns).Get(rbName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if len(userSubjects) == 0 {
+			return nil
+		}
+		subjects := []rbacv1.Subject{}
+		if rbName == "psp:nautilus-user" {
+			subjects = append(subjects, rbacv1.Subject{
+				Kind: "ServiceAccount",
+				Name: "default"})
+		}
+		_, err = clientset.Rbac().RoleBindings(ns).Create(&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: rbName,
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "ClusterRole",
+				Name:     nsRoleBindingRoles[rbName],
+			},
+			Subjects: append(subjects, userSubjects...),
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	allSubjects := []rbacv1.Subject{}
+	for _, subj := range rb.Subjects {
+		if subj.Kind != "User" {
+			allSubjects = append(allSubjects, subj)
+		}
+	}
+	allSubjects = append(allSubjects, userSubjects...)
+
+	if len(allSubjects) == 0 {
+		return clientset.Rbac().RoleBindings(ns).Delete(rbName, &metav1.DeleteOptions{})
+	}
+	if reflect.DeepEqual(rb.Subjects, allSubjects) {
+		return nil
+	}
+	rb.Subjects = allSubjects
+	_, err = clientset.Rbac().RoleBindings(ns).Update(rb)
+	return err
+}
+
+// Removes the user from the portal role bindings in all namespaces. The bindings left without subjects are deleted.
+func removeUserRoleBindings(clientset kubernetes.Interface, userID string) error {
+	rbList, err := clientset.Rbac().RoleBindings("").List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for i := range rbList.Items {
+		rb := &rbList.Items[i]
+		if !isNsRoleBinding(rb.GetName()) {
+			continue
+		}
+		allSubjects, found := withoutUserSubject(rb.Subjects, userID)
+		if !found {
+			continue
+		}
+		if len(allSubjects) == 0 {
+			err = clientset.Rbac().RoleBindings(rb.GetNamespace()).Delete(rb.GetName(), &metav1.DeleteOptions{})
+		} else {
+			rb.Subjects = allSubjects
+			_, err = clientset.Rbac().RoleBindings(rb.GetNamespace()).Update(rb)
+		}
+		if err != nil {
+			log.Printf("Error removing user %s from role binding %s in namespace %s: %s", userID, rb.GetName(), rb.GetNamespace(), err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Removes the user from the role binding in the namespace. The binding left without subjects is deleted.
+func removeUserFromRoleBinding(clientset kubernetes.Interface, ns string, rbName string, userID string) error {
+	rb, err := clientset.Rbac().RoleBindings(ns).Get(rbName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	allSubjects, found := withoutUserSubject(rb.Subjects, userID)
+	if !found {
+		return nil
+	}
+	if len(allSubjects) == 0 {
+		return clientset.Rbac().RoleBindings(ns).Delete(rbName, &metav1.DeleteOptions{})
+	}
+	rb.Subjects = allSubjects
+	_, err = clientset.Rbac().RoleBindings(ns).Update(rb)
+	return err
+}
+
+// Removes the user from the nautilus-cluster-user cluster role binding
+func removeClusterUserBinding(clientset kubernetes.Interface, userID string) error {
+	rb, err := clientset.Rbac().ClusterRoleBindings().Get("nautilus-cluster-user", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	allSubjects, found := withoutUserSubject(rb.Subjects, userID)
+	if !found {
+		return nil
+	}
+	rb.Subjects = allSubjects
+	_, err = clientset.Rbac().ClusterRoleBindings().Update(rb)
+	return err
+}
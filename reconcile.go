@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	"github.com/spf13/viper"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The kinds of drift between the portal role bindings and the users
+const (
+	DriftMissing = "missing" // the user should be in the binding
+	DriftExtra   = "extra"   // the user is in the binding without being a namespace member
+	DriftStale   = "stale"   // the user status records a namespace the user is not a member of
+)
+
+// A difference between the portal-managed role bindings and the PRPUser and NamespaceMember objects
+type RBACDrift struct {
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace,omitempty"` // empty for the nautilus-cluster-user cluster role binding
+	Binding   string `json:"binding,omitempty"`
+	UserID    string `json:"userID"`
+	Kind      string `json:"kind"`
+}
+
+func (drift RBACDrift) String() string {
+	if drift.Namespace == "" {
+		return fmt.Sprintf("%s: user %s %s in cluster role binding %s", drift.Cluster, drift.UserID, drift.Kind, drift.Binding)
+	}
+	if drift.Binding == "" {
+		return fmt.Sprintf("%s: user %s %s record for namespace %s", drift.Cluster, drift.UserID, drift.Kind, drift.Namespace)
+	}
+	return fmt.Sprintf("%s: user %s %s in role binding %s/%s", drift.Cluster, drift.UserID, drift.Kind, drift.Namespace, drift.Binding)
+}
+
+// The namespace roles of the users kept from the role bindings. The users of the other bindings, like the
+// psp:nautilus-user one every member is in, can't be kept, since the binding doesn't tell their role.
+var adoptBindingRoles = map[string]string{
+	"nautilus-viewer":    nautilusapi.NamespaceRoleViewer,
+	"nautilus-editor":    nautilusapi.NamespaceRoleEditor,
+	"nautilus-user":      nautilusapi.NamespaceRoleEditor, // the legacy editors binding
+	"nautilus-admin":     nautilusapi.NamespaceRoleAdmin,
+	"nautilus-admin-ext": nautilusapi.NamespaceRoleAdmin,
+}
+
+// Whether the extra user can be kept as a namespace member from the admin page
+func (drift RBACDrift) Adoptable() bool {
+	_, ok := adoptBindingRoles[drift.Binding]
+	return ok && drift.Kind == DriftExtra && drift.Namespace != ""
+}
+
+// The result of a reconciliation run
+type RBACReport struct {
+	Time     time.Time
+	Drift    []RBACDrift
+	Repaired bool
+	Errors   []string
+}
+
+type RBACTemplateVars struct {
+	IndexTemplateVars
+	Report *RBACReport
+	Mode   string
+}
+
+// Returns the User subjects of the portal role bindings by namespace and binding name
+func actualNsBindings(clientset kubernetes.Interface) (map[string]map[string]map[string]bool, error) {
+	rbList, err := clientset.Rbac().RoleBindings("").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	actual := map[string]map[string]map[string]bool{}
+	for _, rb := range rbList.Items {
+		if !isNsRoleBinding(rb.GetName()) {
+			continue
+		}
+		for _, subj := range rb.Subjects {
+			if subj.Kind == "User" {
+				addBindingSubject(actual, rb.GetNamespace(), rb.GetName(), subj.Name)
+			}
+		}
+	}
+	return actual, nil
+}
+
+func addBindingSubject(bindings map[string]map[string]map[string]bool, ns string, rbName string, userID string) {
+	if bindings[ns] == nil {
+		bindings[ns] = map[string]map[string]bool{}
+	}
+	if bindings[ns][rbName] == nil {
+		bindings[ns][rbName] = map[string]bool{}
+	}
+	bindings[ns][rbName][userID] = true
+}
+
+// Compares the portal role bindings with the ones computed from the users and the namespace members
+func (s *Server) computeRBACDrift() ([]RBACDrift, error) {
+	usersList, err := s.users.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	users := []nautilusapi.PRPUser{}
+	deleting := map[string]bool{}
+	guests := map[string]bool{}
+	for _, user := range usersList.Items {
+		if user.DeletionTimestamp != nil {
+			deleting[user.Spec.UserID] = true
+			continue
+		}
+		users = append(users, user)
+		guests[user.Spec.UserID] = user.IsGuest()
+	}
+
+	membersList, err := s.members.NamespaceMembers("").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	drift := []RBACDrift{}
+
+	// Namespace bindings are only managed in the primary cluster
+	primary := s.clusters[0]
+	nsList, err := primary.clientset.Core().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	nsExists := map[string]bool{}
+	for _, ns := range nsList.Items {
+		nsExists[ns.GetName()] = true
+	}
+
+	// Same rules as syncNamespaceBindings: the members unknown to the portal keep their bindings
+	desired := map[string]map[string]map[string]bool{}
+	isMember := map[string]bool{}
+	for _, member := range membersList.Items {
+		if member.DeletionTimestamp != nil || !nsExists[member.Namespace] {
+			continue
+		}
+		isMember[member.Namespace+"/"+member.Spec.UserID] = true
+		if guests[member.Spec.UserID] || deleting[member.Spec.UserID] {
+			continue
+		}
+		for _, rbName := range memberRoleBindings(member.Spec.Role) {
+			addBindingSubject(desired, member.Namespace, rbName, member.Spec.UserID)
+		}
+	}
+
+	for _, user := range users {
+		for _, ns := range user.Status.Namespaces {
+			if !isMember[ns+"/"+user.Spec.UserID] {
+				drift = append(drift, RBACDrift{Cluster: primary.Name, Namespace: ns, UserID: user.Spec.UserID, Kind: DriftStale})
+			}
+		}
+	}
+
+	actual, err := actualNsBindings(primary.clientset)
+	if err != nil {
+		return nil, err
+	}
+	for ns, bindings := range desired {
+		for rbName, userIDs := range bindings {
+			for userID := range userIDs {
+				if !actual[ns][rbName][userID] {
+					drift = append(drift, RBACDrift{Cluster: primary.Name, Namespace: ns, Binding: rbName, UserID: userID, Kind: DriftMissing})
+				}
+			}
+		}
+	}
+	for ns, bindings := range actual {
+		for rbName, userIDs := range bindings {
+			for userID := range userIDs {
+				if !desired[ns][rbName][userID] {
+					drift = append(drift, RBACDrift{Cluster: primary.Name, Namespace: ns, Binding: rbName, UserID: userID, Kind: DriftExtra})
+				}
+			}
+		}
+	}
+
+	// The cluster user binding has all validated users in every cluster
+	for _, cluster := range s.clusters {
+		actualUsers := map[string]bool{}
+		if rb, err := cluster.clientset.Rbac().ClusterRoleBindings().Get("nautilus-cluster-user", metav1.GetOptions{}); err == nil {
+			for _, subj := range rb.Subjects {
+				if subj.Kind == "User" {
+					actualUsers[subj.Name] = true
+				}
+			}
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		desiredUsers := map[string]bool{}
+		for _, user := range users {
+			if !user.IsGuest() {
+				desiredUsers[user.Spec.UserID] = true
+				if !actualUsers[user.Spec.UserID] {
+					drift = append(drift, RBACDrift{Cluster: cluster.Name, Binding: "nautilus-cluster-user", UserID: user.Spec.UserID, Kind: DriftMissing})
+				}
+			}
+		}
+		for userID := range actualUsers {
+			if !desiredUsers[userID] {
+				drift = append(drift, RBACDrift{Cluster: cluster.Name, Binding: "nautilus-cluster-user", UserID: userID, Kind: DriftExtra})
+			}
+		}
+	}
+
+	sort.Slice(drift, func(i, j int) bool {
+		return drift[i].String() < drift[j].String()
+	})
+	return drift, nil
+}
+
+// Fixes the drift, returning the errors of the failed repairs
+func (s *Server) repairRBACDrift(drift []RBACDrift) []error {
+	errs := []error{}
+	syncedNs := map[string]bool{} // syncNamespaceBindings repairs all bindings of the namespace at once
+
+	for _, d := range drift {
+		cluster := s.getCluster(d.Cluster)
+		if cluster == nil {
+			continue
+		}
+
+		var err error
+		switch {
+		case d.Kind == DriftStale:
+			s.forgetUserNamespace(d.UserID, d.Namespace)
+		case d.Namespace == "" && d.Kind == DriftMissing:
+			var user *nautilusapi.PRPUser
+			if user, err = s.GetUser(d.UserID); err == nil {
+				err = updateClusterUserBinding(cluster.clientset, user)
+			}
+		case d.Namespace == "" && d.Kind == DriftExtra:
+			err = removeClusterUserBinding(cluster.clientset, d.UserID)
+		default:
+			if syncedNs[d.Namespace] {
+				continue
+			}
+			err = s.syncNamespaceBindings(d.Namespace)
+			syncedNs[d.Namespace] = true
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", d, err.Error()))
+		}
+	}
+	return errs
+}
+
+// Keeps the user found in the role binding by making it a namespace member with the role of the binding
+func (s *Server) adoptNamespaceMember(nsName string, userID string, rbName string) error {
+	role, ok := adoptBindingRoles[rbName]
+	if !ok {
+		return fmt.Errorf("The users of role binding %s can't be kept as members", rbName)
+	}
+	if _, err := s.members.NamespaceMembers(nsName).Create(&nautilusapi.NamespaceMember{
+		ObjectMeta: metav1.ObjectMeta{Name: userObjectName(userID)},
+		Spec: nautilusapi.NamespaceMemberSpec{
+			UserID: userID,
+			Role:   role,
+		},
+	}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	s.recordUserNamespace(userID, nsName)
+	return s.syncNamespaceBindings(nsName)
+}
+
+// Computes the drift, repairs it if asked, and keeps the report for the admin page
+func (s *Server) ReconcileRBAC(repair bool) *RBACReport {
+	report := &RBACReport{Time: time.Now()}
+
+	drift, err := s.computeRBACDrift()
+	if err != nil {
+		log.Printf("Error computing the RBAC drift: %s", err.Error())
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		report.Drift = drift
+		for _, d := range drift {
+			log.Printf("RBAC drift: %s", d)
+		}
+		if repair && len(drift) > 0 {
+			for _, err := range s.repairRBACDrift(drift) {
+				log.Printf("Error repairing the RBAC drift: %s", err.Error())
+				report.Errors = append(report.Errors, err.Error())
+			}
+			report.Repaired = true
+		}
+		log.Printf("RBAC reconciliation found %d differences, repaired: %v", len(drift), report.Repaired)
+	}
+
+	s.rbacReportLock.Lock()
+	s.rbacReport = report
+	s.rbacReportLock.Unlock()
+	return report
+}
+
+// Records the repaired drift, and the errors of the failed repairs, in the audit log
+func (s *Server) auditRBACRepair(r *http.Request, user *nautilusapi.PRPUser, report *RBACReport) {
+	if !report.Repaired {
+		return
+	}
+	s.audit(r, user, auditRBACRepair, "rbac", "", report.Drift, report.Errors)
+}
+
+// Periodically reconciles the portal role bindings. rbac_reconcile is "repair", "report" or "off".
+func (s *Server) WatchRBAC(stop <-chan struct{}) {
+	mode := viper.GetString("rbac_reconcile")
+	if mode == "off" {
+		return
+	}
+
+	ticker := time.NewTicker(viper.GetDuration("rbac_reconcile_interval"))
+	defer ticker.Stop()
+	for {
+		s.auditRBACRepair(nil, nil, s.ReconcileRBAC(mode == "repair"))
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Process the /rbac path
+func (s *Server) RBACHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
+	if err != nil {
+		log.Printf("Error getting the session: %s", err.Error())
+	}
+
+	if session.IsNew || session.Values["userid"] == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := s.GetUser(session.Values["userid"].(string))
+	if err != nil {
+		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if user.Spec.Role != nautilusapi.RoleAdmin {
+		session.AddFlash("Unauthorized")
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.rbacReportLock.RLock()
+		report := s.rbacReport
+		s.rbacReportLock.RUnlock()
+
+		t, err := template.New("layout.tmpl").ParseFiles("templates/layout.tmpl", "templates/rbac.tmpl")
+		if err != nil {
+			w.Write([]byte(err.Error()))
+		} else {
+			err = t.ExecuteTemplate(w, "layout.tmpl", RBACTemplateVars{IndexTemplateVars: s.buildIndexTemplateVars(session, w, r), Report: report, Mode: viper.GetString("rbac_reconcile")})
+			if err != nil {
+				w.Write([]byte(err.Error()))
+			}
+		}
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		switch r.PostFormValue("action") {
+		case "check":
+			s.ReconcileRBAC(false)
+		case "repair":
+			report := s.ReconcileRBAC(true)
+			s.auditRBACRepair(r, user, report)
+			session.AddFlash(fmt.Sprintf("Repaired %d differences with %d errors", len(report.Drift), len(report.Errors)))
+			session.Save(r, w)
+			s.ReconcileRBAC(false)
+		case "adopt":
+			if err := s.adoptNamespaceMember(r.PostFormValue("namespace"), r.PostFormValue("user"), r.PostFormValue("binding")); err != nil {
+				session.AddFlash(fmt.Sprintf("Error adding the member: %s", err.Error()))
+				session.Save(r, w)
+			} else {
+				s.audit(r, user, auditRBACAdopt, r.PostFormValue("user"), r.PostFormValue("namespace"), nil, s.namespaceMemberRole(r.PostFormValue("namespace"), r.PostFormValue("user")))
+			}
+			s.ReconcileRBAC(false)
+		}
+		http.Redirect(w, r, "/rbac", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReconcileRBAC(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+	client := env.login(testAdmin)
+
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+	env.post(client, "/profile", url.Values{"addusername": {testUser.Subject}, "adduserns": {"test-ns"}, "adduserrole": {"editor"}})
+	env.server.recordUserNamespace(testUser.Subject, "gone-ns")
+
+	// Drift from manual edits
+	rb, err := env.k8s.Rbac().RoleBindings("test-ns").Get("nautilus-editor", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb.Subjects = append(rb.Subjects, rbacv1.Subject{Kind: "User", APIGroup: "rbac.authorization.k8s.io", Name: "intruder"})
+	if _, err := env.k8s.Rbac().RoleBindings("test-ns").Update(rb); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeUserFromRoleBinding(env.k8s, "test-ns", "psp:nautilus-user", testUser.Subject); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := env.server.computeRBACDrift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RBACDrift{
+		{Cluster: testClusterName, Namespace: "test-ns", Binding: "nautilus-editor", UserID: "intruder", Kind: DriftExtra},
+		{Cluster: testClusterName, Namespace: "test-ns", Binding: "psp:nautilus-user", UserID: testUser.Subject, Kind: DriftMissing},
+		{Cluster: testClusterName, Namespace: "gone-ns", UserID: testUser.Subject, Kind: DriftStale},
+		{Cluster: testClusterName, Binding: "nautilus-cluster-user", UserID: testAdmin.Subject, Kind: DriftMissing},
+		{Cluster: testClusterName, Binding: "nautilus-cluster-user", UserID: testUser.Subject, Kind: DriftMissing},
+	}
+	for _, d := range expected {
+		if !containsDrift(drift, d) {
+			t.Errorf("Expected drift %s in %v", d, drift)
+		}
+	}
+	if len(drift) != len(expected) {
+		t.Errorf("Expected %d differences, got %v", len(expected), drift)
+	}
+
+	report := env.server.ReconcileRBAC(true)
+	if !report.Repaired || len(report.Errors) > 0 {
+		t.Errorf("Unexpected reconciliation report %+v", report)
+	}
+
+	if drift, err := env.server.computeRBACDrift(); err != nil || len(drift) > 0 {
+		t.Errorf("Expected no drift after the repair, got %v %v", drift, err)
+	}
+	if subjects := env.bindingSubjects("test-ns", "nautilus-editor"); containsString(subjects, "User:intruder") {
+		t.Errorf("Extra user was left in the binding: %v", subjects)
+	}
+	if subjects := env.bindingSubjects("test-ns", "psp:nautilus-user"); !containsString(subjects, "User:"+testUser.Subject) {
+		t.Errorf("Missing user was not added back to the binding: %v", subjects)
+	}
+	if user := env.getUser(testUser); containsString(user.Status.Namespaces, "gone-ns") {
+		t.Errorf("Stale namespace was left in the user status: %v", user.Status.Namespaces)
+	}
+}
+
+func TestRBACPage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	env.addUser(testUser, "user")
+
+	admin := env.login(testAdmin)
+	env.post(admin, "/rbac", url.Values{"action": {"check"}})
+	if status, body := env.get(admin, "/rbac"); status != http.StatusOK || !strings.Contains(body, testUser.Subject) {
+		t.Errorf("Expected the drift of the user in the page, got %d: %s", status, body)
+	}
+
+	user := env.login(testUser)
+	if _, body := env.get(user, "/rbac"); strings.Contains(body, "Repair all") {
+		t.Errorf("Non-admin got the RBAC page")
+	}
+}
+
+func TestAdoptNamespaceMember(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, "admin")
+	client := env.login(testAdmin)
+	env.post(client, "/profile", url.Values{"mkns": {"test-ns"}})
+
+	if _, err := env.k8s.Rbac().RoleBindings("test-ns").Create(&rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "nautilus-viewer"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: nsRoleBindingRoles["nautilus-viewer"]},
+		Subjects:   []rbacv1.Subject{{Kind: "User", APIGroup: "rbac.authorization.k8s.io", Name: "viewer-id"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rb, err := env.k8s.Rbac().RoleBindings("test-ns").Get("psp:nautilus-user", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb.Subjects = append(rb.Subjects, rbacv1.Subject{Kind: "User", APIGroup: "rbac.authorization.k8s.io", Name: "psp-id"})
+	if _, err := env.k8s.Rbac().RoleBindings("test-ns").Update(rb); err != nil {
+		t.Fatal(err)
+	}
+
+	env.post(client, "/rbac", url.Values{"action": {"check"}})
+	if _, body := env.get(client, "/rbac"); strings.Count(body, `value="adopt"`) != 1 {
+		t.Errorf("Expected only the viewer to be offered to be kept, got %s", body)
+	}
+
+	for _, d := range []RBACDrift{
+		{Namespace: "test-ns", Binding: "nautilus-viewer", UserID: "viewer-id"},
+		{Namespace: "test-ns", Binding: "psp:nautilus-user", UserID: "psp-id"},
+	} {
+		env.post(client, "/rbac", url.Values{"action": {"adopt"}, "namespace": {d.Namespace}, "binding": {d.Binding}, "user": {d.UserID}})
+	}
+	if role := env.server.namespaceMemberRole("test-ns", "viewer-id"); role != "viewer" {
+		t.Errorf("Expected the user of the viewer binding to be kept as viewer, got %q", role)
+	}
+	if role := env.server.namespaceMemberRole("test-ns", "psp-id"); role != "" {
+		t.Errorf("Expected the user of the psp binding not to be kept, got %q", role)
+	}
+}
+
+func containsDrift(drift []RBACDrift, d RBACDrift) bool {
+	for _, item := range drift {
+		if item == d {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	nautilusclientset "github.com/dimm0/k8s_portal/pkg/client/clientset/versioned"
+	nautilusv1 "github.com/dimm0/k8s_portal/pkg/client/clientset/versioned/typed/optiputer.net/v1"
+	nautilusv1alpha1 "github.com/dimm0/k8s_portal/pkg/client/clientset/versioned/typed/optiputer.net/v1alpha1"
+	nautilusinformers "github.com/dimm0/k8s_portal/pkg/client/informers/externalversions"
+	nautiluslisters "github.com/dimm0/k8s_portal/pkg/client/listers/optiputer.net/v1"
+	"github.com/gorilla/sessions"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Server is the portal web application. It owns the kubernetes and CRD clients,
+// the sessions store and the OIDC configuration, and serves the portal pages.
+type Server struct {
+	clusters           []*Cluster
+	clientset          kubernetes.Interface // primary cluster clientset
+	users              nautilusv1.PRPUserInterface
+	members            nautilusv1.NamespaceMembersGetter
+	membershipRequests nautilusv1alpha1.NamespaceMembershipRequestInterface
+	namespaceTemplates nautilusv1.NamespaceTemplateInterface
+	informerFactory    nautilusinformers.SharedInformerFactory
+	userInformer       cache.SharedIndexInformer
+	userLister         nautiluslisters.PRPUserLister
+	memberInformer     cache.SharedIndexInformer
+	store              sessions.Store
+	provider           *oidc.Provider
+	config             oauth2.Config
+	pubconfig          oauth2.Config
+
+	//keep config file to be requested later by JS
+	keys     map[string][]byte
+	keysLock sync.RWMutex
+
+	//OIDC states
+	states     map[string]string
+	statesLock sync.RWMutex
+
+	podGpusCache map[types.UID][]string
+	podBothered  map[string]string
+
+	//last RBAC reconciliation
+	rbacReport     *RBACReport
+	rbacReportLock sync.RWMutex
+
+	auditLog *AuditLog
+
+	mux     *http.ServeMux
+	handler http.Handler // mux with the middleware
+}
+
+// Creates the server. The first cluster is the primary one, keeping the users.
+func NewServer(clusters []*Cluster, nautilusClientset nautilusclientset.Interface,
+	store sessions.Store, provider *oidc.Provider, config oauth2.Config, pubconfig oauth2.Config) *Server {
+
+	clusters[0].primary = true
+
+	informerFactory := nautilusinformers.NewSharedInformerFactory(nautilusClientset, time.Minute*5)
+	userInformer := informerFactory.Optiputer().V1().PRPUsers()
+	memberInformer := informerFactory.Optiputer().V1().NamespaceMembers()
+
+	s := &Server{
+		clusters:           clusters,
+		clientset:          clusters[0].clientset,
+		users:              nautilusClientset.OptiputerV1().PRPUsers(),
+		members:            nautilusClientset.OptiputerV1(),
+		membershipRequests: nautilusClientset.OptiputerV1alpha1().NamespaceMembershipRequests(),
+		namespaceTemplates: nautilusClientset.OptiputerV1().NamespaceTemplates(),
+		informerFactory:    informerFactory,
+		userInformer:       userInformer.Informer(),
+		userLister:         userInformer.Lister(),
+		memberInformer:     memberInformer.Informer(),
+		store:              store,
+		provider:           provider,
+		config:             config,
+		pubconfig:          pubconfig,
+		keys:               map[string][]byte{},
+		states:             map[string]string{},
+		podGpusCache:       make(map[types.UID][]string),
+		podBothered:        make(map[string]string),
+		auditLog:           NewAuditLog(viper.GetString("audit_log")),
+		mux:                http.NewServeMux(),
+	}
+	s.routes()
+	s.handler = s.csrfMiddleware(s.mux)
+	return s
+}
+
+// Starts the informers and waits for their caches to fill
+func (s *Server) StartInformers(stop <-chan struct{}) error {
+	s.informerFactory.Start(stop)
+	for informerType, synced := range s.informerFactory.WaitForCacheSync(stop) {
+		if !synced {
+			return fmt.Errorf("Failed to sync the %v cache", informerType)
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) routes() {
+	s.mux.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir("/media"))))
+
+	s.mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "/media/favicon.ico")
+	})
+
+	s.mux.HandleFunc("/", s.RootHandler)
+	s.mux.HandleFunc("/namespaces", s.NamespacesHandler)
+	s.mux.HandleFunc("/nodes", s.NodesHandler)
+	s.mux.HandleFunc("/profile", s.ProfileHandler)
+	s.mux.HandleFunc("/nsMeta", s.NsMetaHandler)
+	s.mux.HandleFunc("/quota", s.QuotaHandler)
+	s.mux.HandleFunc("/nsDelete", s.NsDeleteHandler)
+	s.mux.HandleFunc("/tests", s.TestsHandler)
+
+	s.mux.HandleFunc("/authConfig", func(w http.ResponseWriter, r *http.Request) {
+		stateVal := "config"
+		if r.URL.Query().Get("type") == "exec" {
+			stateVal = "config-exec"
+		}
+		http.Redirect(w, r, s.pubconfig.AuthCodeURL(s.newState(stateVal)), http.StatusFound)
+	})
+
+	s.mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, s.config.AuthCodeURL(s.newState("auth")), http.StatusFound)
+	})
+
+	s.mux.HandleFunc("/authCli", s.AuthCliHandler)
+	s.mux.HandleFunc("/cliToken", s.CliTokenHandler)
+	s.mux.HandleFunc("/refreshToken", s.RefreshTokenHandler)
+	s.mux.HandleFunc("/getConfig", s.GetConfigHandler)
+	s.mux.HandleFunc("/callback", s.AuthenticateHandler)
+	s.mux.HandleFunc("/users", s.UsersHandler)
+	s.mux.HandleFunc("/membership", s.MembershipHandler)
+	s.mux.HandleFunc("/rbac", s.RBACHandler)
+	s.mux.HandleFunc("/audit", s.AuditHandler)
+	s.mux.HandleFunc(apiPrefix, s.ApiHandler)
+	s.mux.HandleFunc("/logout", s.LogoutHandler)
+	s.mux.HandleFunc("/cluster", s.SwitchClusterHandler)
+}
+
+// Creates the OIDC state with the value, which expires in 10 minutes
+func (s *Server) newState(stateVal string) string {
+	s.statesLock.Lock()
+	defer s.statesLock.Unlock()
+
+	newState := randStringBytes(36)
+	s.states[newState] = stateVal
+	cleanStateTimer := time.NewTimer(time.Minute * 10)
+	go func() {
+		<-cleanStateTimer.C
+		s.statesLock.Lock()
+		defer s.statesLock.Unlock()
+		delete(s.states, newState)
+	}()
+	return newState
+}
+
+// Keeps the data to be picked up once with the returned id before it expires
+func (s *Server) keepKey(data []byte, expire time.Duration) string {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	newId := randStringBytes(16)
+	s.keys[newId] = data
+	cleanKeyTimer := time.NewTimer(expire)
+	go func() {
+		<-cleanKeyTimer.C
+		s.keysLock.Lock()
+		defer s.keysLock.Unlock()
+		delete(s.keys, newId)
+	}()
+	return newId
+}
+
+// Returns the data kept with the id and forgets it
+func (s *Server) takeKey(id string) ([]byte, bool) {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	data, ok := s.keys[id]
+	if ok {
+		delete(s.keys, id)
+	}
+	return data, ok
+}
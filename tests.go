@@ -35,13 +35,13 @@ type TestTemplateVars struct {
 }
 
 // Process the /tests path
-func TestsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) TestsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "GET" {
 		return
 	}
 
-	session, err := filestore.Get(r, "prp-session")
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -70,8 +70,8 @@ func TestsHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			w.Write([]byte(err.Error()))
 		} else {
-			nodesList, _ := clientset.Core().Nodes().List(metav1.ListOptions{})
-			nsVars := TestTemplateVars{Nodes: nodesList.Items, IndexTemplateVars: buildIndexTemplateVars(session, w, r)}
+			nodesList, _ := s.clientset.Core().Nodes().List(metav1.ListOptions{})
+			nsVars := TestTemplateVars{Nodes: nodesList.Items, IndexTemplateVars: s.buildIndexTemplateVars(session, w, r)}
 			err = t.ExecuteTemplate(w, "layout.tmpl", nsVars)
 			if err != nil {
 				w.Write([]byte(err.Error()))
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// Tokens handed over to the nautilus-login credential plugin
+type CliToken struct {
+	IDToken      string    `json:"id_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// Starts the OIDC flow for the nautilus-login credential plugin listening on the local port
+func (s *Server) AuthCliHandler(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		http.Error(w, "Wrong port value", http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, s.pubconfig.AuthCodeURL(s.newState(fmt.Sprintf("cli:%d", port))), http.StatusFound)
+}
+
+// Keeps the tokens to be picked up by the plugin and sends the browser back to the plugin local port
+func (s *Server) issueCliToken(w http.ResponseWriter, r *http.Request, port string, oauth2Token *oauth2.Token, idToken *oidc.IDToken) {
+	data, err := json.Marshal(CliToken{
+		IDToken:      oauth2Token.Extra("id_token").(string),
+		RefreshToken: oauth2Token.RefreshToken,
+		Expiry:       idToken.Expiry,
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode the token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	newId := s.keepKey(data, time.Minute)
+
+	http.Redirect(w, r, fmt.Sprintf("http://127.0.0.1:%s/callback?code=%s", port, newId), http.StatusFound)
+}
+
+// Returns the tokens for the code passed to the plugin. Can only be called once.
+func (s *Server) CliTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		return
+	}
+
+	id := r.URL.Query().Get("code")
+
+	tokenData, ok := s.takeKey(id)
+	if ok {
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(tokenData)
+	} else {
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// Exchanges the refresh token for the new ID token using the kubectl config client
+func (s *Server) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	refreshToken := r.PostFormValue("refresh_token")
+	if refreshToken == "" {
+		http.Error(w, "Please provide refresh_token", http.StatusBadRequest)
+		return
+	}
+
+	oauth2Token, err := s.pubconfig.TokenSource(r.Context(), &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		http.Error(w, "Failed to refresh token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	rawIdToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "No id_token in the refreshed token", http.StatusInternalServerError)
+		return
+	}
+
+	idToken, err := s.provider.Verifier(&oidc.Config{ClientID: s.pubconfig.ClientID}).Verify(r.Context(), rawIdToken)
+	if err != nil {
+		http.Error(w, "Failed to verify ID Token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	newRefreshToken := oauth2Token.RefreshToken
+	if newRefreshToken == "" {
+		newRefreshToken = refreshToken
+	}
+
+	data, err := json.Marshal(CliToken{
+		IDToken:      rawIdToken,
+		RefreshToken: newRefreshToken,
+		Expiry:       idToken.Expiry,
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode the token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Refreshed token for %s", idToken.Subject)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
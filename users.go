@@ -9,7 +9,7 @@ import (
 	"net/http"
 	"strings"
 
-	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -25,12 +25,13 @@ type AutoCompleteItem struct {
 }
 
 type NamespaceUsers struct {
-	Users  []nautilusapi.PRPUser `json:"users"`
-	Admins []nautilusapi.PRPUser `json:"admins"`
+	Viewers []nautilusapi.PRPUser `json:"viewers"`
+	Editors []nautilusapi.PRPUser `json:"editors"`
+	Admins  []nautilusapi.PRPUser `json:"admins"`
 }
 
-func UsersHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := filestore.Get(r, "prp-session")
+func (s *Server) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSession(r)
 	if err != nil {
 		log.Printf("Error getting the session: %s", err.Error())
 	}
@@ -40,24 +41,18 @@ func UsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUser(session.Values["userid"].(string))
+	user, err := s.GetUser(session.Values["userid"].(string))
 	if err != nil {
 		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
-	if strings.ToLower(user.Spec.Role) != "admin" {
+	if user.Spec.Role != nautilusapi.RoleAdmin {
 		session.AddFlash("Unauthorized")
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
-	}
-
-	userclientset, err := user.GetUserClientset()
-	if err != nil {
-		session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
-		session.Save(r, w)
-		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
@@ -75,7 +70,7 @@ func UsersHandler(w http.ResponseWriter, r *http.Request) {
 				}
 				users := []nautilusapi.PRPUser{}
 				autocompleteUsers := []AutoCompleteItem{}
-				if curusers, err := crdclient.List(meta_v1.ListOptions{}); err == nil {
+				if curusers, err := s.users.List(meta_v1.ListOptions{}); err == nil {
 					users = curusers.Items
 					for _, user := range users {
 						if strings.Contains(strings.ToLower(user.Spec.Name+" "+user.Spec.Email), strings.ToLower(term)) {
@@ -97,7 +92,7 @@ func UsersHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			case "general":
 				users := []nautilusapi.PRPUser{}
-				if curusers, err := crdclient.List(meta_v1.ListOptions{}); err == nil {
+				if curusers, err := s.users.List(meta_v1.ListOptions{}); err == nil {
 					users = curusers.Items
 					if usersJson, err := json.Marshal(users); err == nil {
 						w.Write(usersJson)
@@ -119,29 +114,11 @@ func UsersHandler(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
-				nsUsers := NamespaceUsers{}
-
-				for _, role := range []string{"user", "admin"} {
-					if userBindings, err := userclientset.Rbac().RoleBindings(r.URL.Query().Get("namespace")).Get("nautilus-"+role, meta_v1.GetOptions{}); err == nil {
-						if len(userBindings.Subjects) > 0 {
-							users := []nautilusapi.PRPUser{}
-							for _, userBinding := range userBindings.Subjects {
-								if user, err := GetUser(userBinding.Name); err == nil {
-									users = append(users, *user)
-								} else {
-									w.WriteHeader(http.StatusInternalServerError)
-									w.Write([]byte(fmt.Sprintf("Error getting user: %s", err.Error())))
-									return
-								}
-							}
-							switch role {
-							case "user":
-								nsUsers.Users = users
-							case "admin":
-								nsUsers.Admins = users
-							}
-						}
-					}
+				nsUsers, err := s.getNamespaceUsers(r.URL.Query().Get("namespace"))
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(err.Error()))
+					return
 				}
 
 				if nsUsersJson, err := json.Marshal(nsUsers); err == nil {
@@ -164,7 +141,7 @@ func UsersHandler(w http.ResponseWriter, r *http.Request) {
 			users := []nautilusapi.PRPUser{}
 			var mailAllBuf bytes.Buffer
 
-			if curusers, err := crdclient.List(meta_v1.ListOptions{}); err == nil {
+			if curusers, err := s.users.List(meta_v1.ListOptions{}); err == nil {
 				users = curusers.Items
 
 				for _, user := range users {
@@ -175,7 +152,7 @@ func UsersHandler(w http.ResponseWriter, r *http.Request) {
 				session.Save(r, w)
 			}
 
-			vars := UsersTemplateVars{buildIndexTemplateVars(session, w, r), users, mailAllBuf.String()}
+			vars := UsersTemplateVars{s.buildIndexTemplateVars(session, w, r), users, mailAllBuf.String()}
 
 			err = t.Execute(w, vars)
 			if err != nil {
@@ -188,30 +165,109 @@ func UsersHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		changeUser, err := GetUser(r.PostFormValue("user"))
+		changeUser, err := s.GetUser(r.PostFormValue("user"))
 		if err != nil {
 			session.AddFlash(fmt.Sprintf("Unexpected error: %s", err.Error()))
 			session.Save(r, w)
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
-		if strings.ToLower(changeUser.Spec.Role) == "guest" && r.PostFormValue("action") == "validate" {
-			changeUser.Spec.Role = "user"
-			_, err := crdclient.Update(changeUser)
-			if err != nil {
+
+		if changeUser.Spec.UserID == user.Spec.UserID {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("You can't change your own account"))
+			return
+		}
+
+		newRole := ""
+		switch action := r.PostFormValue("action"); {
+		case action == "validate" && changeUser.Spec.Role == nautilusapi.RoleGuest:
+			newRole = nautilusapi.RoleUser
+		case action == "unvalidate" && changeUser.Spec.Role == nautilusapi.RoleUser:
+			newRole = nautilusapi.RoleGuest
+		case action == "promote" && changeUser.Spec.Role == nautilusapi.RoleUser:
+			newRole = nautilusapi.RoleAdmin
+		case action == "demote" && changeUser.Spec.Role == nautilusapi.RoleAdmin:
+			newRole = nautilusapi.RoleUser
+		case action == "delete":
+			if err := s.deleteUser(changeUser); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(fmt.Sprintf("Error updating user: %s", err.Error())))
+				w.Write([]byte(fmt.Sprintf("Error deleting user: %s", err.Error())))
 				return
 			}
-		} else if strings.ToLower(changeUser.Spec.Role) == "user" && r.PostFormValue("action") == "unvalidate" {
-			changeUser.Spec.Role = "guest"
-			_, err := crdclient.Update(changeUser)
+			s.audit(r, user, auditUserDelete, changeUser.Spec.UserID, "", map[string]string{"email": changeUser.Spec.Email, "role": changeUser.Spec.Role}, nil)
+			w.Write([]byte("deleted"))
+			return
+		}
+
+		if newRole != "" {
+			oldRole := changeUser.Spec.Role
+			newUser, err := s.changeUserRole(changeUser, newRole)
+			// The role is changed even if the bindings failed to sync
+			if newUser != nil {
+				s.audit(r, user, auditUserRole, newUser.Spec.UserID, "", oldRole, newUser.Spec.Role)
+			}
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(fmt.Sprintf("Error updating user: %s", err.Error())))
 				return
 			}
+			changeUser = newUser
 		}
 		w.Write([]byte(changeUser.Spec.Role))
 	}
 }
+
+// Changes the user role. The namespace roles are kept, and the namespace bindings are synced, since guests have none.
+func (s *Server) changeUserRole(user *nautilusapi.PRPUser, role string) (*nautilusapi.PRPUser, error) {
+	user.Spec.Role = role
+	newUser, err := s.users.Update(user)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := s.userMemberships(newUser.Spec.UserID)
+	if err != nil {
+		return newUser, err
+	}
+	for _, member := range memberships {
+		if err := s.syncNamespaceBindings(member.Namespace); err != nil {
+			return newUser, err
+		}
+	}
+	return newUser, nil
+}
+
+// Deletes the user. The role bindings are cleaned up right away, so that the page shows the result;
+// the finalizer does the same for the users deleted by other means.
+func (s *Server) deleteUser(user *nautilusapi.PRPUser) error {
+	if err := s.cleanupUserBindings(user.Spec.UserID); err != nil {
+		return err
+	}
+	return s.users.Delete(user.Name, &meta_v1.DeleteOptions{})
+}
+
+// Returns the members of the namespace
+func (s *Server) getNamespaceUsers(nsName string) (NamespaceUsers, error) {
+	nsUsers := NamespaceUsers{}
+
+	membersList, err := s.members.NamespaceMembers(nsName).List(meta_v1.ListOptions{})
+	if err != nil {
+		return nsUsers, err
+	}
+	for _, member := range membersList.Items {
+		user, err := s.GetUser(member.Spec.UserID)
+		if err != nil {
+			return nsUsers, fmt.Errorf("Error getting user: %s", err.Error())
+		}
+		switch member.Spec.Role {
+		case nautilusapi.NamespaceRoleViewer:
+			nsUsers.Viewers = append(nsUsers.Viewers, *user)
+		case nautilusapi.NamespaceRoleEditor:
+			nsUsers.Editors = append(nsUsers.Editors, *user)
+		case nautilusapi.NamespaceRoleAdmin:
+			nsUsers.Admins = append(nsUsers.Admins, *user)
+		}
+	}
+	return nsUsers, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Applies the change to the user status, retrying on conflicts.
+// Falls back to updating the whole object when the status subresource is not enabled in the cluster.
+func (s *Server) updateUserStatus(userID string, change func(status *nautilusapi.PRPUserStatus)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		user, err := s.users.Get(userObjectName(userID), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		change(&user.Status)
+
+		if _, err = s.users.UpdateStatus(user); apierrors.IsNotFound(err) || apierrors.IsMethodNotSupported(err) {
+			_, err = s.users.Update(user)
+		}
+		return err
+	})
+}
+
+// Records the user login through the portal
+func (s *Server) recordUserLogin(userID string, idp string) {
+	if err := s.updateUserStatus(userID, func(status *nautilusapi.PRPUserStatus) {
+		now := metav1.NewTime(time.Now())
+		if status.FirstLogin == nil {
+			status.FirstLogin = &now
+		}
+		status.LastLogin = &now
+		status.LastIDP = idp
+	}); err != nil {
+		log.Printf("Error recording the login of user %s: %s", userID, err.Error())
+	}
+}
+
+// Records the kubeconfig download by the user
+func (s *Server) recordConfigDownload(userID string) {
+	if err := s.updateUserStatus(userID, func(status *nautilusapi.PRPUserStatus) {
+		now := metav1.NewTime(time.Now())
+		status.LastConfigDownload = &now
+	}); err != nil {
+		log.Printf("Error recording the config download of user %s: %s", userID, err.Error())
+	}
+}
+
+// Records the namespace the user was bound to
+func (s *Server) recordUserNamespace(userID string, nsName string) {
+	if err := s.updateUserStatus(userID, func(status *nautilusapi.PRPUserStatus) {
+		for _, ns := range status.Namespaces {
+			if ns == nsName {
+				return
+			}
+		}
+		status.Namespaces = append(status.Namespaces, nsName)
+	}); err != nil {
+		log.Printf("Error recording namespace %s of user %s: %s", nsName, userID, err.Error())
+	}
+}
+
+// Removes the namespace the user was unbound from
+func (s *Server) forgetUserNamespace(userID string, nsName string) {
+	if err := s.updateUserStatus(userID, func(status *nautilusapi.PRPUserStatus) {
+		namespaces := []string{}
+		for _, ns := range status.Namespaces {
+			if ns != nsName {
+				namespaces = append(namespaces, ns)
+			}
+		}
+		status.Namespaces = namespaces
+	}); err != nil {
+		log.Printf("Error removing namespace %s of user %s: %s", nsName, userID, err.Error())
+	}
+}
+
+// Removes the deleted namespace from all users
+func (s *Server) forgetNamespace(nsName string) {
+	usersList, err := s.users.List(metav1.ListOptions{})
+	if err != nil {
+		log.Printf("Error getting the users: %s", err.Error())
+		return
+	}
+	for _, user := range usersList.Items {
+		for _, ns := range user.Status.Namespaces {
+			if ns == nsName {
+				s.forgetUserNamespace(user.Spec.UserID, nsName)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	nautilusv1alpha1api "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1alpha1"
+	"github.com/spf13/viper"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	webhookConfigName = "nautilus-portal"
+	webhookName       = "prpusers.optiputer.net"
+	webhookPath       = "/admit/prpusers"
+)
+
+// Loads the webhook certificate, registers the validating webhook for PRPUsers in the primary cluster
+// and serves it over TLS in the background
+func (s *Server) StartWebhook() error {
+	serviceName := viper.GetString("webhook_service")
+	namespace := viper.GetString("webhook_namespace")
+
+	cert, caBundle, err := loadWebhookCert(serviceName, namespace)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookPath, s.AdmitUserHandler)
+	webhookServer := &http.Server{
+		Addr:      viper.GetString("webhook_addr"),
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	go func() {
+		log.Printf("serving the admission webhook on https://%s%s", webhookServer.Addr, webhookPath)
+		log.Fatal(webhookServer.ListenAndServeTLS("", ""))
+	}()
+
+	return registerWebhook(s.clientset, serviceName, namespace, caBundle)
+}
+
+// Returns the configured webhook certificate, or generates a self-signed one for the webhook service.
+// The second value is the CA bundle the API server uses to verify the certificate.
+func loadWebhookCert(serviceName string, namespace string) (tls.Certificate, []byte, error) {
+	if certFile, keyFile := viper.GetString("webhook_cert"), viper.GetString("webhook_key"); certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return cert, nil, err
+		}
+		caFile := viper.GetString("webhook_ca")
+		if caFile == "" {
+			caFile = certFile
+		}
+		caBundle, err := ioutil.ReadFile(caFile)
+		return cert, caBundle, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	host := fmt.Sprintf("%s.%s.svc", serviceName, namespace)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host, host + ".cluster.local"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return cert, certPEM, err
+}
+
+// Creates or updates the validating webhook configuration pointing to the portal service
+func registerWebhook(clientset kubernetes.Interface, serviceName string, namespace string, caBundle []byte) error {
+	path := webhookPath
+	failurePolicy := admissionregv1beta1.Fail
+
+	webhooks := []admissionregv1beta1.Webhook{
+		{
+			Name: webhookName,
+			ClientConfig: admissionregv1beta1.WebhookClientConfig{
+				Service: &admissionregv1beta1.ServiceReference{
+					Namespace: namespace,
+					Name:      serviceName,
+					Path:      &path,
+				},
+				CABundle: caBundle,
+			},
+			Rules: []admissionregv1beta1.RuleWithOperations{
+				{
+					Operations: []admissionregv1beta1.OperationType{admissionregv1beta1.Create, admissionregv1beta1.Update},
+					Rule: admissionregv1beta1.Rule{
+						APIGroups:   []string{nautilusapi.CRDGroup},
+						APIVersions: []string{nautilusapi.CRDVersion, nautilusv1alpha1api.CRDVersion},
+						Resources:   []string{nautilusapi.CRDPlural},
+					},
+				},
+			},
+			FailurePolicy: &failurePolicy,
+		},
+	}
+
+	webhookConfigs := clientset.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations()
+	existing, err := webhookConfigs.Get(webhookConfigName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = webhookConfigs.Create(&admissionregv1beta1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: webhookConfigName},
+			Webhooks:   webhooks,
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	existing.Webhooks = webhooks
+	_, err = webhookConfigs.Update(existing)
+	return err
+}
+
+// Validates the PRPUser changes sent by the API server
+func (s *Server) AdmitUserHandler(w http.ResponseWriter, r *http.Request) {
+	review := admissionv1beta1.AdmissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "Bad admission review", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = s.admitUser(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Printf("Error writing the admission response: %s", err.Error())
+	}
+}
+
+// Checks the user create or update request against the role rules
+func (s *Server) admitUser(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	newUser, err := decodeAdmissionUser(req.Kind.Version, req.Object.Raw)
+	if err != nil {
+		return denyAdmission(http.StatusBadRequest, fmt.Sprintf("Error reading the user: %s", err.Error()))
+	}
+
+	var oldUser *nautilusapi.PRPUser
+	if req.Operation == admissionv1beta1.Update {
+		if oldUser, err = decodeAdmissionUser(req.Kind.Version, req.OldObject.Raw); err != nil {
+			return denyAdmission(http.StatusBadRequest, fmt.Sprintf("Error reading the user: %s", err.Error()))
+		}
+	}
+
+	if err := s.validateUserChange(req.UserInfo, oldUser, newUser); err != nil {
+		log.Printf("Denied the change of user %s by %s: %s", newUser.Name, req.UserInfo.Username, err.Error())
+		return denyAdmission(http.StatusForbidden, err.Error())
+	}
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+// Decodes the user sent in the admission request in the given version
+func decodeAdmissionUser(version string, raw []byte) (*nautilusapi.PRPUser, error) {
+	if version == nautilusv1alpha1api.CRDVersion {
+		oldUser := &nautilusv1alpha1api.PRPUser{}
+		if err := json.Unmarshal(raw, oldUser); err != nil {
+			return nil, err
+		}
+		return nautilusapi.ConvertFromV1alpha1(oldUser), nil
+	}
+
+	user := &nautilusapi.PRPUser{}
+	if err := json.Unmarshal(raw, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func denyAdmission(code int32, message string) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: message,
+		},
+	}
+}
+
+// Checks the user change by the requester. oldUser is nil for new users.
+// UserID and ISS can't be changed. Only admins can give or take the admin role, and nobody can change their own role.
+// The cluster admins and the users listed in webhook_privileged_users (f.e. the portal itself) can change any role.
+func (s *Server) validateUserChange(requester authenticationv1.UserInfo, oldUser *nautilusapi.PRPUser, newUser *nautilusapi.PRPUser) error {
+	oldRole := ""
+	if oldUser != nil {
+		if oldUser.Spec.UserID != newUser.Spec.UserID {
+			return fmt.Errorf("userID can't be changed")
+		}
+		if oldUser.Spec.ISS != newUser.Spec.ISS {
+			return fmt.Errorf("iss can't be changed")
+		}
+		oldRole = oldUser.Spec.Role
+	}
+
+	if oldRole == newUser.Spec.Role || isPrivilegedRequester(requester) {
+		return nil
+	}
+
+	if oldUser != nil && requester.Username == oldUser.Spec.UserID {
+		return fmt.Errorf("users can't change their own role")
+	}
+
+	if oldRole == nautilusapi.RoleAdmin || newUser.Spec.Role == nautilusapi.RoleAdmin {
+		if admin, err := s.GetUser(requester.Username); err != nil || admin.Spec.Role != nautilusapi.RoleAdmin {
+			return fmt.Errorf("only admins can change the admin role")
+		}
+	}
+	return nil
+}
+
+// Returns true if the requester is a cluster admin or is listed in webhook_privileged_users
+func isPrivilegedRequester(requester authenticationv1.UserInfo) bool {
+	for _, group := range requester.Groups {
+		if group == "system:masters" {
+			return true
+		}
+	}
+	for _, username := range viper.GetStringSlice("webhook_privileged_users") {
+		if username == requester.Username {
+			return true
+		}
+	}
+	return false
+}
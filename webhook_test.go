@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	nautilusapi "github.com/dimm0/k8s_portal/pkg/apis/optiputer.net/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Sends the admission review for the user change to the webhook handler.
+// oldUser is nil for creates.
+func (env *testEnv) admit(requester authenticationv1.UserInfo, oldUser *nautilusapi.PRPUser, newUser *nautilusapi.PRPUser) *admissionv1beta1.AdmissionResponse {
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "test-uid",
+		Kind:      metav1.GroupVersionKind{Group: nautilusapi.CRDGroup, Version: nautilusapi.CRDVersion, Kind: "PRPUser"},
+		Operation: admissionv1beta1.Create,
+		UserInfo:  requester,
+	}
+	req.Object.Raw, _ = json.Marshal(newUser)
+	if oldUser != nil {
+		req.Operation = admissionv1beta1.Update
+		req.OldObject.Raw, _ = json.Marshal(oldUser)
+	}
+
+	body, _ := json.Marshal(admissionv1beta1.AdmissionReview{Request: req})
+	rec := httptest.NewRecorder()
+	env.server.AdmitUserHandler(rec, httptest.NewRequest("POST", webhookPath, bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		env.t.Fatalf("Webhook returned %d", rec.Code)
+	}
+
+	review := admissionv1beta1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		env.t.Fatalf("Failed to read the admission review: %s", err.Error())
+	}
+	if review.Response == nil || review.Response.UID != req.UID {
+		env.t.Fatalf("Unexpected admission response %+v", review.Response)
+	}
+	return review.Response
+}
+
+func withRole(user *nautilusapi.PRPUser, role string) *nautilusapi.PRPUser {
+	changed := user.DeepCopy()
+	changed.Spec.Role = role
+	return changed
+}
+
+func TestWebhookRoleChanges(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addUser(testAdmin, nautilusapi.RoleAdmin)
+	user := env.addUser(testUser, nautilusapi.RoleUser)
+	guest := env.addUser(testGuest, nautilusapi.RoleGuest)
+
+	admin := authenticationv1.UserInfo{Username: testAdmin.Subject}
+	regular := authenticationv1.UserInfo{Username: testUser.Subject}
+	masters := authenticationv1.UserInfo{Username: "kubernetes-admin", Groups: []string{"system:masters"}}
+
+	tests := []struct {
+		name      string
+		requester authenticationv1.UserInfo
+		oldUser   *nautilusapi.PRPUser
+		newUser   *nautilusapi.PRPUser
+		allowed   bool
+	}{
+		{"admin promotes a user", admin, user, withRole(user, nautilusapi.RoleAdmin), true},
+		{"admin validates a guest", admin, guest, withRole(guest, nautilusapi.RoleUser), true},
+		{"user validates a guest", regular, guest, withRole(guest, nautilusapi.RoleUser), true},
+		{"user promotes a guest", regular, guest, withRole(guest, nautilusapi.RoleAdmin), false},
+		{"user promotes themselves", regular, user, withRole(user, nautilusapi.RoleAdmin), false},
+		{"user unvalidates themselves", regular, user, withRole(user, nautilusapi.RoleGuest), false},
+		{"user changes their email", regular, user, func() *nautilusapi.PRPUser {
+			changed := user.DeepCopy()
+			changed.Spec.Email = "new@example.com"
+			return changed
+		}(), true},
+		{"cluster admin promotes a user", masters, user, withRole(user, nautilusapi.RoleAdmin), true},
+		{"user creates an admin", regular, nil, withRole(guest, nautilusapi.RoleAdmin), false},
+		{"user creates a guest", regular, nil, guest, true},
+		{"admin changes the user ID", admin, user, func() *nautilusapi.PRPUser {
+			changed := user.DeepCopy()
+			changed.Spec.UserID = testAdmin.Subject
+			return changed
+		}(), false},
+		{"cluster admin changes the issuer", masters, user, func() *nautilusapi.PRPUser {
+			changed := user.DeepCopy()
+			changed.Spec.ISS = "https://other.example.com"
+			return changed
+		}(), false},
+	}
+
+	for _, test := range tests {
+		response := env.admit(test.requester, test.oldUser, test.newUser)
+		if response.Allowed != test.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v (%v)", test.name, test.allowed, response.Allowed, response.Result)
+		}
+		if !response.Allowed && (response.Result == nil || response.Result.Message == "") {
+			t.Errorf("%s: denied without a message", test.name)
+		}
+	}
+}
+
+func TestWebhookBadRequest(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	rec := httptest.NewRecorder()
+	env.server.AdmitUserHandler(rec, httptest.NewRequest("POST", webhookPath, bytes.NewReader([]byte("{"))))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request, got %d", rec.Code)
+	}
+}
+
+func TestWebhookCertificate(t *testing.T) {
+	cert, caBundle, err := loadWebhookCert("nautilus-portal", "kube-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) == 0 || len(caBundle) == 0 {
+		t.Fatal("Empty webhook certificate")
+	}
+
+	env := newTestEnv(t)
+	defer env.Close()
+	if err := registerWebhook(env.k8s, "nautilus-portal", "kube-system", caBundle); err != nil {
+		t.Fatal(err)
+	}
+	// Registering again updates the existing configuration
+	if err := registerWebhook(env.k8s, "nautilus-portal", "kube-system", caBundle); err != nil {
+		t.Fatal(err)
+	}
+	config, err := env.k8s.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get(webhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Webhooks) != 1 || !bytes.Equal(config.Webhooks[0].ClientConfig.CABundle, caBundle) {
+		t.Errorf("Unexpected webhook configuration %+v", config.Webhooks)
+	}
+}